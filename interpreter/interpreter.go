@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"luingo/logging"
 	"luingo/parser"
 	"luingo/vm"
@@ -11,7 +12,19 @@ import (
 )
 
 var Globals = map[string]vm.Value{
-	"print": vm.NewFuntion(vm.Print),
+	"collectgarbage": vm.NewFuntion(vm.CollectGarbage),
+	"ipairs":         vm.NewFuntion(vm.IPairs),
+	"next":           vm.NewFuntion(vm.Next),
+	"pairs":          vm.NewFuntion(vm.Pairs),
+	"print":          vm.NewFuntion(vm.Print),
+	"rawget":         vm.NewFuntion(vm.RawGet),
+	"rawset":         vm.NewFuntion(vm.RawSet),
+	"select":         vm.NewFuntion(vm.Select),
+	"setmetatable":   vm.NewFuntion(vm.SetMetatable),
+	"getmetatable":   vm.NewFuntion(vm.GetMetatable),
+	"string":         vm.NewStringLibrary(),
+	"table":          vm.NewTableLibrary(),
+	"tostring":       vm.NewFuntion(vm.ToString),
 }
 
 type Options struct {
@@ -41,23 +54,17 @@ func NewInterpreter(code string, options Options) Interpreter {
 func (i Interpreter) Execute(ctx context.Context) error {
 	logger := logging.Logger(ctx)
 	start := time.Now()
-	constants, byteCodes, err := i.parser.Parse()
+	prototype, err := i.parser.Parse()
 	if err != nil {
 		return fmt.Errorf("parsing content: %w", err)
 	}
 	logger.Debug("Parsing complete", "duration", time.Since(start))
 
-	for i, constant := range constants {
-		logger.Debug(fmt.Sprintf("constant: %v=%+v", i, constant))
-	}
-
-	for i, byteCode := range byteCodes {
-		logger.Debug(fmt.Sprintf("bytecode: %v=%+v", i, byteCode))
-	}
+	logPrototype(logger, "main", prototype)
 
 	start = time.Now()
 
-	err = i.vm.Execute(ctx, constants, byteCodes)
+	err = i.vm.Execute(ctx, prototype)
 	if err != nil {
 		return fmt.Errorf("Executing byte code: %v\n", err)
 	}
@@ -66,3 +73,17 @@ func (i Interpreter) Execute(ctx context.Context) error {
 
 	return nil
 }
+
+func logPrototype(logger *slog.Logger, name string, prototype *vm.Prototype) {
+	for i, constant := range prototype.Constants {
+		logger.Debug(fmt.Sprintf("%v constant: %v=%+v", name, i, constant))
+	}
+
+	for i, byteCode := range prototype.ByteCodes {
+		logger.Debug(fmt.Sprintf("%v bytecode: %v=%+v", name, i, byteCode))
+	}
+
+	for i, nested := range prototype.Prototypes {
+		logPrototype(logger, fmt.Sprintf("%v.%v", name, i), nested)
+	}
+}
@@ -2,8 +2,11 @@ package interpreter
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"luingo/logging"
+	"luingo/vm"
+	"maps"
 	"os"
 	"path"
 	"strings"
@@ -18,13 +21,14 @@ func Test(t *testing.T) {
 	testCases := []struct {
 		desc       string
 		filePath   string
+		globals    map[string]vm.Value
 		wantOutput []string
 		wantErr    assert.ErrorAssertionFunc
 	}{
 		{
 			desc:       "print.lua",
 			filePath:   path.Join("testdata", "print.lua"),
-			wantOutput: []string{"hello, world!", "<nil>", "false", "123", "123456", "123456"},
+			wantOutput: []string{"hello, world!", "<nil>", "false", "123", "123456", "123456.0"},
 			wantErr:    assert.NoError,
 		},
 		{
@@ -42,9 +46,45 @@ func Test(t *testing.T) {
 		{
 			desc:       "table.lua",
 			filePath:   path.Join("testdata", "table.lua"),
-			wantOutput: []string{"100", "hello", "vvv", "Table{0=<nil>,1=100,2=200,3=300,kkk=vvv,x=hello,y=world}"},
+			wantOutput: []string{"100", "hello", "vvv", "Table{1=100,2=200,3=300,kkk=vvv,x=hello,y=world}"},
 			wantErr:    assert.NoError,
 		},
+		{
+			desc:     "tables.lua",
+			filePath: path.Join("testdata", "tables.lua"),
+			wantOutput: []string{
+				"a\tb2\t2", "20\t2\t40", "18", "true", "10\tfloat\tlarge\tlarge", "3\t1\t<nil>\t3", "0\t0",
+				"9\tnew",
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:     "iteration.lua",
+			filePath: path.Join("testdata", "iteration.lua"),
+			wantOutput: []string{
+				"1\t10", "2\t20", "3\t30", "x\ta", "y\tb", "z\tc", "<nil>", "1\t1", "2\t2",
+				"1\t1", "2\t4", "3\t9", "only\t1", "<nil>\t<nil>\t1\t5",
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:       "next_invalid_key.lua",
+			filePath:   path.Join("testdata", "next_invalid_key.lua"),
+			wantOutput: []string{"<nil>"},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "table_nil_key.lua",
+			filePath:   path.Join("testdata", "table_nil_key.lua"),
+			wantOutput: []string{"1"},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "table_nan_key.lua",
+			filePath:   path.Join("testdata", "table_nan_key.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
 		{
 			desc:       "prefixexp.lua",
 			filePath:   path.Join("testdata", "prefixexp.lua"),
@@ -57,6 +97,392 @@ func Test(t *testing.T) {
 			wantOutput: []string{"-101","-101","-3.14","-3.14","10","10","true","true","false","false"},
 			wantErr: assert.NoError,
 		},
+		{
+			desc:     "arithmetic.lua",
+			filePath: path.Join("testdata", "arithmetic.lua"),
+			wantOutput: []string{
+				"9", "1", "15", "3.5", "3", "-4", "-1", "1", "7.5", "1.5", "512.0", "-4.0", "3.5", "-9223372036854775808", "-2", "17", "15",
+				"2.0", "1.0", "4.0", "2.0\t2\ttrue", "7.0\t3.0\t2.0",
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:       "comparison.lua",
+			filePath:   path.Join("testdata", "comparison.lua"),
+			wantOutput: []string{"true", "false", "true", "true", "true", "false", "true", "true", "true", "true", "false", "true", "false", "true", "false", "false", "true"},
+			wantErr:    assert.NoError,
+		},
+		{
+			desc:       "comparison_error.lua",
+			filePath:   path.Join("testdata", "comparison_error.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "logical_operations.lua",
+			filePath:   path.Join("testdata", "logical_operations.lua"),
+			wantOutput: []string{"1", "false", "<nil>", "x", "true", "false", "false", "<nil>", "yes", "no", "default", "inner", "zero is true", "3"},
+			wantErr:    assert.NoError,
+		},
+		{
+			desc:       "if.lua",
+			filePath:   path.Join("testdata", "if.lua"),
+			wantOutput: []string{"greater", "not smaller", "five", "else", "inner", "5", "<nil>", "true", "nested", "assigned"},
+			wantErr:    assert.NoError,
+		},
+		{
+			desc:       "loops.lua",
+			filePath:   path.Join("testdata", "loops.lua"),
+			wantOutput: []string{"0", "1", "2", "1", "4", "3", "once"},
+			wantErr:    assert.NoError,
+		},
+		{
+			desc:       "break_error.lua",
+			filePath:   path.Join("testdata", "break_error.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "numeric_for.lua",
+			filePath:   path.Join("testdata", "numeric_for.lua"),
+			wantOutput: []string{"1", "2", "3", "3", "2", "1", "0.25", "0.75", "1", "2", "9223372036854775806", "9223372036854775807", "-9223372036854775807", "-9223372036854775808", "2", "4", "6", "5050", "1", "2", "<nil>", "1", "2"},
+			wantErr:    assert.NoError,
+		},
+		{
+			desc:       "numeric_for_step_zero.lua",
+			filePath:   path.Join("testdata", "numeric_for_step_zero.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:     "generic_for.lua",
+			filePath: path.Join("testdata", "generic_for.lua"),
+			globals: globalsWith(map[string]vm.Value{
+				// count(limit, control) yields control+1 and its square until limit is reached
+				"count": vm.NewFuntion(func(v *vm.VM) (int, error) {
+					limit, _ := v.Arg(0).Integer()
+					control, _ := v.Arg(1).Integer()
+					if control >= limit {
+						return 0, nil
+					}
+					v.Push(vm.NewInteger(control + 1))
+					v.Push(vm.NewInteger((control + 1) * (control + 1)))
+					return 2, nil
+				}),
+			}),
+			wantOutput: []string{"1", "2", "3", "1", "4", "9", "8", "<nil>", "9", "<nil>", "10", "<nil>", "10", "20", "<nil>"},
+			wantErr:    assert.NoError,
+		},
+		{
+			desc:     "zero_value.lua",
+			filePath: path.Join("testdata", "zero_value.lua"),
+			globals: globalsWith(map[string]vm.Value{
+				// zero returns the zero Value like cleared and padded stack slots hold
+				"zero": vm.NewFuntion(func(v *vm.VM) (int, error) {
+					v.Push(vm.Value{})
+					return 1, nil
+				}),
+			}),
+			wantOutput: []string{"<nil>\ttrue\ttrue\t<nil>", "3\t<nil>"},
+			wantErr:    assert.NoError,
+		},
+		{
+			desc:       "division_by_zero.lua",
+			filePath:   path.Join("testdata", "division_by_zero.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "functions.lua",
+			filePath:   path.Join("testdata", "functions.lua"),
+			wantOutput: []string{"hello", "<nil>", "twice", "twice", "42", "2", "42", "inner", "outer", "3", "2", "1"},
+			wantErr:    assert.NoError,
+		},
+		{
+			desc:       "function_break_error.lua",
+			filePath:   path.Join("testdata", "function_break_error.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "closures.lua",
+			filePath:   path.Join("testdata", "closures.lua"),
+			wantOutput: []string{"2", "1", "3", "10", "20", "1", "2", "3", "outer", "changed", "2", "1"},
+			wantErr:    assert.NoError,
+		},
+		{
+			desc:     "multiple_returns.lua",
+			filePath: path.Join("testdata", "multiple_returns.lua"),
+			wantOutput: []string{
+				"1\t2", "1\t2\t<nil>", "1", "1", "1\tend", "start\t1\t2", "", "<nil>\t1",
+				"Table{1=1,2=2}", "Table{1=1,2=1,3=2}", "Table{1=1}", "Table{1=1,key=value}",
+				"a\tb", "0\ta\tb", "a\t10", "a\tb\tc", "positive\tother", "1", "2", "3", "55",
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:       "return_not_last.lua",
+			filePath:   path.Join("testdata", "return_not_last.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:     "varargs.lua",
+			filePath: path.Join("testdata", "varargs.lua"),
+			wantOutput: []string{
+				"0\t1\t3", "1\t2\t3", "1\tend", "1", "1\t<nil>", "<nil>\t<nil>", "1\t2\t3\t4\t5", "3\t4",
+				"b\tc", "c", "", "Table{1=1,2=2,3=3}", "Table{2=main}",
+				"3\tx\t<nil>\tz", "b\tc", "10", "3",
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:       "vararg_outside_function.lua",
+			filePath:   path.Join("testdata", "vararg_outside_function.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "select_out_of_range.lua",
+			filePath:   path.Join("testdata", "select_out_of_range.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "methods.lua",
+			filePath:   path.Join("testdata", "methods.lua"),
+			wantOutput: []string{"150", "120", "125", "<\tinner\t>", "!\tinner\t<nil>", "3", "3", "2", "3"},
+			wantErr:    assert.NoError,
+		},
+		{
+			desc:       "method_call_error.lua",
+			filePath:   path.Join("testdata", "method_call_error.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:     "concat.lua",
+			filePath: path.Join("testdata", "concat.lua"),
+			wantOutput: []string{
+				"hello, world", "<lua>", "12", "n=10,2.5", "1e+15\t1e+100\t9.2233720368548e+18", "-0.0\t1.0\t1.5\t0.1",
+				"inf\t-inf", "sum: 3!", "true", "xylua", "call!", "xyzlua", "123",
+				"0.0\t-0.0", "-inf\tinf",
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:       "concat_error.lua",
+			filePath:   path.Join("testdata", "concat_error.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:     "bitwise.lua",
+			filePath: path.Join("testdata", "bitwise.lua"),
+			wantOutput: []string{
+				"2\t7\t5", "8\t14\t6\t-13", "16\t16\t15\t-9223372036854775808", "0\t0\t0", "0\t64", "8\t8",
+				"1\t3\t-1\t4", "3", "6\t8", "true",
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:       "bitwise_float_error.lua",
+			filePath:   path.Join("testdata", "bitwise_float_error.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "goto.lua",
+			filePath:   path.Join("testdata", "goto.lua"),
+			wantOutput: []string{"1", "2", "3", "odd\t1", "odd\t3", "odd\t5", "found\t2\t2", "ab", "1\t2", "10\t20", "closed"},
+			wantErr:    assert.NoError,
+		},
+		{
+			desc:       "goto_into_scope.lua",
+			filePath:   path.Join("testdata", "goto_into_scope.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "goto_duplicate_label.lua",
+			filePath:   path.Join("testdata", "goto_duplicate_label.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "goto_duplicate_void_label.lua",
+			filePath:   path.Join("testdata", "goto_duplicate_void_label.lua"),
+			wantOutput: []string{},
+			wantErr: func(t assert.TestingT, err error, msgAndArgs ...any) bool {
+				// the error is reported at the second label
+				return assert.ErrorContains(t, err, "label 'label' already defined at {line:1 col:2} {line:1 col:12}", msgAndArgs...)
+			},
+		},
+		{
+			desc:       "goto_missing_label.lua",
+			filePath:   path.Join("testdata", "goto_missing_label.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "scopes.lua",
+			filePath:   path.Join("testdata", "scopes.lua"),
+			wantOutput: []string{"2", "3", "2", "1", "2", "visible\t<nil>", "inner\touter", "10\t11", "8", "10", "1", "20", "2", "first\tsecond", "a\tc", "a\tb"},
+			wantErr:    assert.NoError,
+		},
+		{
+			desc:       "attributes.lua",
+			filePath:   path.Join("testdata", "attributes.lua"),
+			wantOutput: []string{"10\tlua\thello", "30", "100", "30", "<nil>\tfalse", "2", "2\t10"},
+			wantErr:    assert.NoError,
+		},
+		{
+			desc:       "const_assign.lua",
+			filePath:   path.Join("testdata", "const_assign.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "const_upvalue_assign.lua",
+			filePath:   path.Join("testdata", "const_upvalue_assign.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "unknown_attribute.lua",
+			filePath:   path.Join("testdata", "unknown_attribute.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "close_non_closable.lua",
+			filePath:   path.Join("testdata", "close_non_closable.lua"),
+			wantOutput: []string{"before"},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:     "metatables.lua",
+			filePath: path.Join("testdata", "metatables.lua"),
+			wantOutput: []string{
+				"<nil>", "true\ttrue", "true\t<nil>", "locked", "LUA\tlua\t3", "el\tllo\thello-hello", "true\tX", "HEY!",
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:       "protected_metatable.lua",
+			filePath:   path.Join("testdata", "protected_metatable.lua"),
+			wantOutput: []string{"false"},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "setmetatable_error.lua",
+			filePath:   path.Join("testdata", "setmetatable_error.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:     "index_metamethods.lua",
+			filePath: path.Join("testdata", "index_metamethods.lua"),
+			wantOutput: []string{
+				"rex makes a sound\trex fetches\t<nil>", "yes\tunknown?\t1?", "<nil>\tx=1", "2\t2\t<nil>", "3",
+				"function\t3", "1\t<nil>",
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:       "index_loop.lua",
+			filePath:   path.Join("testdata", "index_loop.lua"),
+			wantOutput: []string{"before"},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "index_nil.lua",
+			filePath:   path.Join("testdata", "index_nil.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:     "operator_metamethods.lua",
+			filePath: path.Join("testdata", "operator_metamethods.lua"),
+			globals: globalsWith(map[string]vm.Value{
+				"newUserdata": vm.NewFuntion(func(v *vm.VM) (int, error) {
+					v.Push(v.NewUserdata(nil, v.Arg(0)))
+					return 1, nil
+				}),
+			}),
+			wantOutput: []string{
+				"4\t6", "2\t2", "4\t3", "-1\t7", "true\tfalse\tfalse\ttrue", "true\ttrue\tfalse\tfalse",
+				"true\tfalse\ttrue\tfalse",
+				"v=(1,2)!\t(1,2)(3,4)", "band\tbor\tbxor\tshl\tshr\tbnot", "idiv\tdiv\tmod\tpow",
+				"first\tsecond\tsecond", "0",
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:       "arithmetic_metamethod_missing.lua",
+			filePath:   path.Join("testdata", "arithmetic_metamethod_missing.lua"),
+			wantOutput: []string{"before"},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "comparison_metamethod_missing.lua",
+			filePath:   path.Join("testdata", "comparison_metamethod_missing.lua"),
+			wantOutput: []string{"true"},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:     "call_tostring_metamethods.lua",
+			filePath: path.Join("testdata", "call_tostring_metamethods.lua"),
+			wantOutput: []string{
+				"11\t16", "Counter(16)\tCounter(16)", "1\t<nil>\ts\ttrue", "4", "42", "Point: ", "true",
+				"1.0\tinf\t-inf\t9.007199254741e+15\ttrue",
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:     "close_metamethods.lua",
+			filePath: path.Join("testdata", "close_metamethods.lua"),
+			wantOutput: []string{
+				"body", "close\tb\t<nil>", "close\ta\t<nil>", "close\t1\t<nil>", "close\t2\t<nil>",
+				"close\treturn\t<nil>", "value", "close\tgoto\t<nil>", "close\tgoto\t<nil>", "for\t1", "for\t2",
+				"close\tfor\t<nil>",
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:       "close_on_error.lua",
+			filePath:   path.Join("testdata", "close_on_error.lua"),
+			wantOutput: []string{"closed\ttrue"},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:       "tostring_error.lua",
+			filePath:   path.Join("testdata", "tostring_error.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
+		{
+			desc:     "gc.lua",
+			filePath: path.Join("testdata", "gc.lua"),
+			globals: globalsWith(map[string]vm.Value{
+				"newUserdata": vm.NewFuntion(func(v *vm.VM) (int, error) {
+					v.Push(v.NewUserdata(nil, v.Arg(0)))
+					return 1, nil
+				}),
+			}),
+			wantOutput: []string{
+				"finalized\ttemporary", "collected", "<nil>\tstrings stay\ttrue", "Table{Table{}=2}\t2", "userdata finalized\ttrue",
+				"same table\ttrue", "finalized\tcyclic\ttrue\tkey", "cyclic collected", "finalized\tclass\ttrue",
+				"class collected", "true", "end", "finalized\trenamed",
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:       "collectgarbage_error.lua",
+			filePath:   path.Join("testdata", "collectgarbage_error.lua"),
+			wantOutput: []string{},
+			wantErr:    assert.Error,
+		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
@@ -65,8 +491,12 @@ func Test(t *testing.T) {
 
 			var output strings.Builder
 
+			globals := tC.globals
+			if globals == nil {
+				globals = Globals
+			}
 			interpreter := NewInterpreter(string(input), Options{
-				Globals,
+				globals,
 				&output,
 			})
 
@@ -97,3 +527,62 @@ func Test(t *testing.T) {
 		})
 	}
 }
+
+// TestLimits checks that functions exceeding the number of locals, constants or nested functions byte codes
+// can refer to are rejected instead of referring to the wrong ones.
+func TestLimits(t *testing.T) {
+	// repeat joins the lines produced by line for the indexes 0 to count-1
+	repeat := func(count int, line func(i int) string) string {
+		lines := make([]string, count)
+		for i := range lines {
+			lines[i] = line(i)
+		}
+		return strings.Join(lines, "\n")
+	}
+	locals := func(count int) string {
+		return repeat(count, func(i int) string { return fmt.Sprintf("local l%v = %v", i, i) }) +
+			fmt.Sprintf("\nprint(l%v)", count-1)
+	}
+	functions := func(count int) string {
+		return "local t = {}\n" + repeat(count, func(i int) string { return fmt.Sprintf("t[%v] = function() return %v end", i, i) }) +
+			fmt.Sprintf("\nprint(t[%v]())", count-1)
+	}
+	// the names print and x are constants as well
+	constants := func(count int) string {
+		return "local p = print\n" + repeat(count-2, func(i int) string { return fmt.Sprintf("x = \"c%v\"", i) }) + "\np(x)"
+	}
+
+	testCases := []struct {
+		desc       string
+		code       string
+		wantOutput []string
+		wantErr    assert.ErrorAssertionFunc
+	}{
+		{"200 locals", locals(200), []string{"199"}, assert.NoError},
+		{"201 locals", locals(201), []string{}, assert.Error},
+		{"256 functions", functions(256), []string{"255"}, assert.NoError},
+		{"257 functions", functions(257), []string{}, assert.Error},
+		{"256 constants", constants(256), []string{"c253"}, assert.NoError},
+		{"257 constants", constants(257), []string{}, assert.Error},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var output strings.Builder
+			interpreter := NewInterpreter(tC.code, Options{Globals, &output})
+
+			ctx := logging.WithLogger(context.Background(), slog.New(slog.DiscardHandler))
+			err := interpreter.Execute(ctx)
+			tC.wantErr(t, err)
+
+			gotOutput := strings.Split(output.String(), "\n")
+			gotOutput = gotOutput[:len(gotOutput)-1] // last element is empty
+			assert.Equal(t, tC.wantOutput, gotOutput)
+		})
+	}
+}
+
+func globalsWith(additional map[string]vm.Value) map[string]vm.Value {
+	globals := maps.Clone(Globals)
+	maps.Copy(globals, additional)
+	return globals
+}
@@ -0,0 +1,25 @@
+local a, b = 7, 2
+local f = 0.5
+local max = 9223372036854775807
+print(a + b)
+print(a - b * 3)
+print((a - b) * 3)
+print(a / b)
+print(a // b)
+print(-a // b)
+print(a % -b)
+print(-a % b)
+print(a + f)
+print(5.5 % 2)
+print(2 ^ 3 ^ 2)
+print(-2 ^ 2)
+print(1 + 2 * 3 - 7 / 2)
+print(max + 1)
+print(max * 2)
+print("10" + a)
+print(a * b + a // b % 2)
+print(4 / 2)
+print(a / 7)
+print(2 ^ 2)
+print((6 / 3) .. "", 6 // 3 .. "", 4 / 2 == 2)
+print(a * 1.0, 7.0 // b, 10 / 5 // 1)
@@ -0,0 +1,3 @@
+local t = setmetatable({}, {})
+print("before")
+print(t + 1)
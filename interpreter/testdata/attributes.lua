@@ -0,0 +1,33 @@
+local limit <const> = 10
+local name <const>, greeting <const> = "lua", "hello"
+print(limit, name, greeting)
+
+local function scaled(x)
+  return x * limit
+end
+print(scaled(3))
+
+local values <const> = {count = 1}
+values.count = 100
+print(values.count)
+
+local computed <const> = scaled(2)
+print(computed + limit)
+
+local nothing <close> = nil
+local disabled <close> = false
+print(nothing, disabled)
+
+for i = 1, 2 do
+  local step <const> = i * 2
+  local skipped <close> = nil
+  if i == 2 then break end
+  print(step)
+end
+
+local function shadow()
+  local limit = 1
+  limit = limit + 1
+  return limit
+end
+print(shadow(), limit)
@@ -0,0 +1,12 @@
+print(6 & 3, 6 | 3, 6 ~ 3)
+local a, b = 12, 10
+print(a & b, a | b, a ~ b, ~a)
+print(1 << 4, 256 >> 4, -1 >> 60, 1 << 63)
+print(1 << 64, 1 >> 64, -1 << 64)
+print(1 << -2, 16 >> -2)
+local shift = -3
+print(64 << shift, 1 >> shift)
+print(3.0 & 1, 2.0 | 1.0, ~0.0, "12" & 4)
+print(1 | 2 ~ 3 & 4 << 1)
+print(1 + 2 << 1, 1 << 1 + 2)
+print(5 & 3 == 1)
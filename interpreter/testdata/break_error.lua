@@ -0,0 +1,2 @@
+print("unreachable")
+break
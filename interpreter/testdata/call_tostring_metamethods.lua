@@ -0,0 +1,29 @@
+local Counter = setmetatable({}, {__call = function(self, start)
+  return setmetatable({count = start}, self)
+end})
+Counter.__index = Counter
+Counter.__call = function(self, step)
+  self.count = self.count + step
+  return self.count
+end
+Counter.__tostring = function(self)
+  return "Counter(" .. self.count .. ")"
+end
+
+local counter = Counter(10)
+print(counter(1), counter(5))
+print(counter, tostring(counter))
+print(tostring(1), tostring(nil), tostring("s"), tostring(true))
+
+local forward = setmetatable({}, {__call = function(...) return select("#", ...) end})
+print(forward(1, 2, 3))
+
+local chained = setmetatable({}, {__call = setmetatable({}, {__call = function(inner, outer, x)
+  return x * 2
+end})})
+print(chained(21))
+
+local named = setmetatable({}, {__name = "Point"})
+print(tostring(named):sub(1, 7))
+print(#tostring(setmetatable({}, {__name = "P"})) > 3)
+print(tostring(1.0), tostring(1/0), tostring(-1/0), 2^53, tostring(0.1) == 0.1 .. "")
@@ -0,0 +1,37 @@
+local function resource(name)
+  return setmetatable({}, {__close = function(self, err)
+    print("close", name, err)
+  end})
+end
+
+do
+  local a <close> = resource("a")
+  local b <close> = resource("b")
+  print("body")
+end
+
+for i = 1, 3 do
+  local r <close> = resource(i)
+  if i == 2 then break end
+end
+
+local function f()
+  local r <close> = resource("return")
+  return "value"
+end
+print(f())
+
+local i = 0
+::again::
+do
+  local r <close> = resource("goto")
+  i = i + 1
+  if i < 2 then goto again end
+end
+
+local function iterator(state, control)
+  if control < 2 then return control + 1 end
+end
+for x in iterator, nil, 0, resource("for") do
+  print("for", x)
+end
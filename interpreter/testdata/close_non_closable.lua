@@ -0,0 +1,3 @@
+print("before")
+local x <close> = 1
+print("after")
@@ -0,0 +1,7 @@
+local function fail()
+  local r <close> = setmetatable({}, {__close = function(self, err)
+    print("closed", err ~= nil)
+  end})
+  local x = nil + 1
+end
+fail()
@@ -0,0 +1,63 @@
+local function makeCounter()
+  local count = 0
+  increment = function() count = count + 1 end
+  show = function() print(count) end
+end
+makeCounter()
+increment()
+increment()
+show()
+
+for i = 1, 3 do
+  if i == 1 then first = function() print(i) end end
+  last = function() print(i) end
+end
+first()
+last()
+
+local j = 0
+while j < 2 do
+  j = j + 1
+  local captured = j * 10
+  if j == 1 then first = function() print(captured) end end
+  last = function() print(captured) end
+end
+first()
+last()
+
+local k = 0
+repeat
+  k = k + 1
+  local captured = k
+  if k == 1 then first = function() print(captured) end end
+  last = function() print(captured) end
+until captured >= 2
+first()
+last()
+
+for i = 1, 10 do
+  local captured = i
+  last = function() print(captured) end
+  if i == 3 then break end
+end
+local a, b, c, d, e = 1, 2, 3, 4, 5
+last()
+
+local outer = "outer"
+local function level1()
+  local function level2()
+    print(outer)
+    outer = "changed"
+  end
+  level2()
+end
+level1()
+print(outer)
+
+local function countdown(n)
+  if n > 0 then
+    print(n)
+    countdown(n - 1)
+  end
+end
+countdown(2)
@@ -0,0 +1 @@
+collectgarbage("unknown")
@@ -0,0 +1,19 @@
+local i, f, s = 1, 1.0, "abc"
+local t, u = {}, {}
+print(i == f)
+print(i ~= f)
+print(1 < 1.5)
+print(i <= f)
+print(2 > i)
+print(i >= 2)
+print(s < "abd")
+print("b" > s)
+print(s == "abc")
+print(t == t)
+print(t == u)
+print(print == print)
+print(nil == false)
+print(1 + 1 == 2)
+print(9007199254740993 <= 9007199254740992.0)
+print(9007199254740993 == 9007199254740992.0)
+print(-9007199254740993 < -9007199254740992.0)
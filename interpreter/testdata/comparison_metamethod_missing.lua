@@ -0,0 +1,3 @@
+local t = setmetatable({}, {__lt = function() return true end})
+print(t < t)
+print(t <= t)
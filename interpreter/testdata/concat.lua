@@ -0,0 +1,28 @@
+print("hello" .. ", " .. "world")
+local name = "lua"
+print("<" .. name .. ">")
+print(1 .. 2)
+print("n=" .. 10 .. "," .. 2.5)
+print(1e15 .. "", 1e100 .. "", 2^63 .. "")
+print(-0.0 .. "", 1.0 .. "", 3 / 2 .. "", 0.1 .. "")
+print(1 / 0 .. "", -1 / 0 .. "")
+print("sum: " .. 1 + 2 .. "!")
+print("a" .. "b" == "ab")
+
+local t = {first = "x", second = "y"}
+print(t.first .. t.second .. name)
+
+local function suffix()
+    return "!", "ignored"
+end
+print("call" .. suffix())
+print(("x" .. "y") .. ("z" .. name))
+
+local parts = ""
+for i = 1, 3 do
+    parts = parts .. i
+end
+print(parts)
+print(0.0 .. "", -0.0 .. "")
+local zero = 0.0
+print(1 / -0.0, 1 / zero)
@@ -0,0 +1,40 @@
+function greet(name)
+  print(name)
+end
+greet("hello")
+greet()
+
+local function twice(f, value)
+  f(value)
+  f(value)
+end
+twice(print, "twice")
+
+local t = {}
+function t.show(x) print(x) end
+t.show(42)
+t.nested = {}
+function t.nested.deep(a, b) print(b) end
+t.nested.deep(1, 2, 3)
+
+local double = function(a) print(a * 2) end
+double(21)
+
+local x = "outer"
+function shadow(a)
+  local x = "inner"
+  for i = 1, 2 do
+    if i == 2 then break end
+    print(x)
+  end
+end
+shadow()
+print(x)
+
+function countdown(n)
+  if n > 0 then
+    print(n)
+    countdown(n - 1)
+  end
+end
+countdown(3)
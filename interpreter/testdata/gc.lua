@@ -0,0 +1,61 @@
+local mt = {__gc = function(self) print("finalized", self.name) end}
+do
+  local temporary = setmetatable({name = "temporary"}, mt)
+end
+collectgarbage()
+print("collected")
+
+local kept = setmetatable({name = "kept"}, mt)
+kept.name = "renamed"
+
+local cache = setmetatable({}, {__mode = "v"})
+local strong = {}
+cache.collectable = {}
+cache.text = "strings stay"
+cache.strong = strong
+collectgarbage()
+print(cache.collectable, cache.text, cache.strong == strong)
+
+local registry = setmetatable({}, {__mode = "k"})
+registry[{}] = 1
+registry[strong] = 2
+collectgarbage()
+print(registry, registry[strong])
+
+local resourceName
+local resource = newUserdata({__name = "Resource", __gc = function(self)
+  print("userdata finalized", tostring(self) == resourceName)
+end})
+resourceName = tostring(resource)
+resource = nil
+collectgarbage()
+local trackedName
+local tracked = {__name = "Tracked", __gc = function(self) print("same table", tostring(self) == trackedName) end}
+do
+  local object = setmetatable({}, tracked)
+  trackedName = tostring(object)
+end
+collectgarbage()
+
+-- tables referring to themselves are collected as well, the finalizer sees the references to itself
+local cyclicMt = {__gc = function(self) print("finalized", self.name, self.self == self, self[self]) end}
+do
+  local cyclic = {name = "cyclic"}
+  cyclic.self = cyclic
+  setmetatable(cyclic, cyclicMt)
+  cyclic[cyclic] = "key"
+end
+collectgarbage()
+print("cyclic collected")
+
+do
+  local class = {name = "class"}
+  class.__index = class
+  class.__gc = function(self) print("finalized", self.name, getmetatable(self) == self) end
+  setmetatable(class, class)
+end
+collectgarbage()
+print("class collected")
+
+print(collectgarbage("count") > 0)
+print("end")
@@ -0,0 +1,14 @@
+for i in count, 3, 0 do print(i) end
+for i, square in count, 3, 0 do print(square) end
+for i in count, 0, 0 do print("never") end
+local state, control = 10, 7
+for i, square, missing in count, state, control do
+  print(i)
+  print(missing)
+end
+for i in count, 100, 0 do
+  if i > 2 then break end
+  local i = i * 10
+  print(i)
+end
+print(i)
@@ -0,0 +1,89 @@
+-- a loop built from goto
+local i = 1
+::top::
+if i <= 3 then
+    print(i)
+    i = i + 1
+    goto top
+end
+
+-- continue
+for j = 1, 5 do
+    if j % 2 == 0 then
+        goto continue
+    end
+    print("odd", j)
+    ::continue::
+end
+
+-- leaving nested loops
+for x = 1, 3 do
+    for y = 1, 3 do
+        if x * y == 4 then
+            print("found", x, y)
+            goto done
+        end
+    end
+end
+::done::
+
+-- a state machine
+local state, steps = "a", ""
+::dispatch::
+if state == "a" then
+    steps = steps .. "a"
+    state = "b"
+    goto dispatch
+elseif state == "b" then
+    steps = steps .. "b"
+    state = "c"
+    goto dispatch
+end
+print(steps)
+
+-- closures capture a fresh local on every jump
+local n = 1
+::again::
+if true then
+    local captured = n
+    if n == 1 then
+        first = function() return captured end
+    else
+        second = function() return captured end
+    end
+end
+n = n + 1
+if n <= 2 then
+    goto again
+end
+print(first(), second())
+
+-- a label at the end of a block may be jumped to over locals
+if true then
+    goto finish
+    local skipped = 1
+    print(skipped)
+    ::finish::
+end
+
+-- a backward jump closes captured locals
+local round = 1
+::loop::
+local value = round * 10
+if round == 1 then
+    getter = function() return value end
+end
+round = round + 1
+if round <= 2 then
+    goto loop
+end
+print(getter(), value)
+
+-- a forward jump out of a block closes captured locals
+if true then
+    local inner = "closed"
+    reader = function() return inner end
+    goto out
+end
+::out::
+print(reader())
@@ -0,0 +1,4 @@
+::label::
+if true then
+    ::label::
+end
@@ -0,0 +1 @@
+::label:: ::label::
@@ -0,0 +1,4 @@
+if true then
+    ::inner::
+end
+goto inner
@@ -0,0 +1,25 @@
+local x = 5
+if x > 3 then print("greater") end
+if x < 3 then print("smaller") else print("not smaller") end
+if x == 1 then
+  print("one")
+elseif x == 5 then
+  print("five")
+elseif x == 5 then
+  print("five again")
+else
+  print("other")
+end
+if nil then print("nil") elseif false then print("false") else print("else") end
+if x then
+  local x = "inner"
+  local y = "y"
+  print(x)
+end
+print(x)
+print(y)
+if true then print("true") end
+if x > 0 then if x > 4 then print("nested") end end
+local z
+if x == 5 and z == nil then z = "assigned" end
+print(z)
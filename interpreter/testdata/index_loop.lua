@@ -0,0 +1,4 @@
+local t = setmetatable({}, {})
+getmetatable(t).__index = t
+print("before")
+print(t.missing)
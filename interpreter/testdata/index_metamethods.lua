@@ -0,0 +1,51 @@
+local Animal = {}
+Animal.__index = Animal
+
+function Animal.new(name)
+  return setmetatable({name = name}, Animal)
+end
+
+function Animal:speak()
+  return self.name .. " makes a sound"
+end
+
+local Dog = setmetatable({}, {__index = Animal})
+Dog.__index = Dog
+
+function Dog.new(name)
+  return setmetatable(Animal.new(name), Dog)
+end
+
+function Dog:fetch()
+  return self.name .. " fetches"
+end
+
+local rex = Dog.new("rex")
+print(rex:speak(), rex:fetch(), rex.missing)
+
+local defaults = setmetatable({}, {__index = function(t, key)
+  return key .. "?"
+end})
+defaults.known = "yes"
+print(defaults.known, defaults.unknown, defaults[1])
+
+local log = {}
+local logged = setmetatable({}, {__newindex = function(t, key, value)
+  log.last = key .. "=" .. value
+end})
+logged.x = 1
+print(logged.x, log.last)
+
+local store = {}
+local proxy = setmetatable({}, {__index = store, __newindex = store})
+proxy.y = 2
+print(proxy.y, store.y, rawget(proxy, "y"))
+
+local existing = setmetatable({z = 1}, {__newindex = function() print("not called") end})
+existing.z = 3
+print(existing.z)
+
+print(("abc").len, ("abc"):len())
+
+rawset(logged, "raw", 1)
+print(rawget(logged, "raw"), rawget(defaults, "unknown"))
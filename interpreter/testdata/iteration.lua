@@ -0,0 +1,30 @@
+local t = {10, 20, 30, x = "a", y = "b"}
+t.z = "c"
+for k, v in pairs(t) do
+  print(k, v)
+end
+
+-- fields may be cleared while traversing
+for k in pairs(t) do
+  t[k] = nil
+end
+print(next(t))
+
+local list = {1, 2, nil, 4}
+for i, v in ipairs(list) do
+  print(i, v)
+end
+
+local proxy = setmetatable({}, {
+  __index = function(_, i) if i <= 3 then return i * i end end,
+  __pairs = function(self) return function(_, k) if not k then return "only", 1 end end, self, nil end,
+})
+for i, v in ipairs(proxy) do
+  print(i, v)
+end
+for k, v in pairs(proxy) do
+  print(k, v)
+end
+
+local k, v = next({}, nil)
+print(k, v, next({5}))
@@ -0,0 +1,16 @@
+local t, f = true, false
+print(t and 1)
+print(f and 1)
+print(nil and 1)
+print(f or "x")
+print(t or undefined())
+print(f and undefined())
+print(nil or false)
+print(false or nil)
+local a = 1 < 2 and "yes" or "no"
+print(a)
+print(1 > 2 and "yes" or "no")
+print(t and f or "default")
+print(f or t and "inner")
+print(0 and "zero is true")
+print(g or 1 + 2)
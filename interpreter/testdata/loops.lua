@@ -0,0 +1,30 @@
+local i = 0
+while i < 3 do
+  print(i)
+  i = i + 1
+end
+local n = 10
+repeat
+  local half = n // 2
+  n = half
+until half < 2
+print(n)
+local count = 0
+while true do
+  count = count + 1
+  if count == 4 then break end
+end
+print(count)
+local j = 0
+repeat
+  j = j + 1
+  local k = 0
+  while true do
+    k = k + 1
+    if k >= j then break end
+  end
+  if j == 3 then break end
+until false
+print(j)
+while false do print("never") end
+repeat print("once") until true
@@ -0,0 +1,18 @@
+local t = {}
+local mt = {}
+print(getmetatable(t))
+print(setmetatable(t, mt) == t, getmetatable(t) == mt)
+print(setmetatable(t, nil) == t, getmetatable(t))
+
+local protected = setmetatable({}, {__metatable = "locked"})
+print(getmetatable(protected))
+
+print(("lua"):upper(), ("LuA"):lower(), ("abc"):len())
+local s = "hello"
+print(s:sub(2, 3), s:sub(-3), s:rep(2, "-"))
+print(getmetatable("x").__index == string, string.upper("x"))
+
+function string.shout(value)
+  return value:upper() .. "!"
+end
+print(("hey"):shout())
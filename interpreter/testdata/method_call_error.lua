@@ -0,0 +1,2 @@
+local number = 1
+number:method()
@@ -0,0 +1,43 @@
+local account = {balance = 100}
+
+function account:deposit(amount)
+    self.balance = self.balance + amount
+    return self.balance
+end
+
+function account.withdraw(self, amount)
+    self.balance = self.balance - amount
+end
+
+print(account:deposit(50))
+account:withdraw(30)
+print(account.balance)
+print(account.deposit(account, 5))
+
+local objects = {inner = {name = "inner"}}
+function objects.inner:describe(prefix, suffix)
+    return prefix, self.name, suffix
+end
+print(objects.inner:describe("<", ">"))
+print(objects.inner:describe"!")
+
+function account:config(options)
+    return options.level
+end
+print(account:config{level = 3})
+
+local function pair(...)
+    return ...
+end
+function account:count(...)
+    return select('#', ...)
+end
+print(account:count(pair(1, 2, 3)))
+print((account:count(1, 2)))
+
+local counter = {n = 0}
+function counter:increment()
+    self.n = self.n + 1
+    return self
+end
+print(counter:increment():increment():increment().n)
@@ -0,0 +1,46 @@
+local function pair() return 1, 2 end
+local function none() end
+local function three() return "a", "b", "c" end
+
+print(pair())
+local x, y, z = pair()
+print(x, y, z)
+local a = pair()
+print(a)
+print((pair()))
+print(pair(), "end")
+print("start", pair())
+print(none())
+print(none(), 1)
+
+print({pair()})
+print({pair(), pair()})
+print({(pair())})
+print({pair(), key = "value"})
+
+x, y = three()
+print(x, y)
+x, y, z = 0, three()
+print(x, y, z)
+x, y = three(), 10
+print(x, y)
+
+local function passthrough(f) return f() end
+print(passthrough(three))
+
+local function early(n)
+  if n > 0 then return "positive" end
+  return "other"
+end
+print(early(1), early(0))
+
+local function range(limit, control)
+  if control < limit then return control + 1 end
+end
+for i in range, 3, 0 do print(i) end
+
+function fib(n)
+  if n < 2 then return n end
+  return fib(n - 1) + fib(n - 2)
+end
+print(fib(10))
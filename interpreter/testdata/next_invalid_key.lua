@@ -0,0 +1,3 @@
+local t = {a = 1}
+print(next(t, "a"))
+next(t, "missing")
@@ -0,0 +1,24 @@
+for i = 1, 3 do print(i) end
+for i = 3, 1, -1 do print(i) end
+for i = 1, 0 do print("never") end
+for f = 0.25, 1, 0.5 do print(f) end
+for i = 1, 2.5 do print(i) end
+for i = 9223372036854775806, 9223372036854775807 do print(i) end
+for i = -9223372036854775807, -9223372036854775807 - 1, -1 do print(i) end
+for i = 1, 3 do
+  local j = i * 2
+  i = 10
+  print(j)
+end
+local sum = 0
+for i = 1, 100 do sum = sum + i end
+print(sum)
+for i = 1, 10 do
+  if i == 3 then break end
+  print(i)
+end
+print(i)
+for i = 1, 1e100 do
+  if i > 2 then break end
+  print(i)
+end
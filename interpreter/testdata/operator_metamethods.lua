@@ -0,0 +1,60 @@
+local Vector = {}
+Vector.__index = Vector
+
+local function vector(x, y)
+  return setmetatable({x = x, y = y}, Vector)
+end
+
+Vector.__add = function(a, b) return vector(a.x + b.x, a.y + b.y) end
+Vector.__sub = function(a, b) return vector(a.x - b.x, a.y - b.y) end
+Vector.__mul = function(a, b)
+  if getmetatable(a) ~= Vector then return vector(a * b.x, a * b.y) end
+  return vector(a.x * b, a.y * b)
+end
+Vector.__unm = function(a) return vector(-a.x, -a.y) end
+Vector.__eq = function(a, b) return a.x == b.x and a.y == b.y end
+Vector.__lt = function(a, b) return a.x < b.x end
+Vector.__le = function(a, b) return a.x <= b.x end
+Vector.__len = function(a) return a.x + a.y end
+Vector.__concat = function(a, b)
+  if getmetatable(a) == Vector then a = "(" .. a.x .. "," .. a.y .. ")" end
+  if getmetatable(b) == Vector then b = "(" .. b.x .. "," .. b.y .. ")" end
+  return a .. b
+end
+
+local a, b = vector(1, 2), vector(3, 4)
+local sum = a + b
+print(sum.x, sum.y)
+local difference = b - a
+print(difference.x, difference.y)
+print((a * 2).y, (3 * a).x)
+print((-a).x, #b)
+print(a == vector(1, 2), a ~= vector(1, 2), a == b, a ~= b)
+print(a < b, a <= b, a > b, a >= b)
+
+local Handle = {__eq = function(x, y) return true end}
+local handle, other = newUserdata(Handle), newUserdata(Handle)
+print(handle == other, handle ~= other, handle == newUserdata(nil), handle == setmetatable({}, Handle))
+print("v=" .. a .. "!", a .. b)
+
+local Bits = {}
+Bits.__band = function(a, b) return "band" end
+Bits.__bor = function(a, b) return "bor" end
+Bits.__bxor = function(a, b) return "bxor" end
+Bits.__shl = function(a, b) return "shl" end
+Bits.__shr = function(a, b) return "shr" end
+Bits.__bnot = function(a) return "bnot" end
+Bits.__idiv = function(a, b) return "idiv" end
+Bits.__div = function(a, b) return "div" end
+Bits.__mod = function(a, b) return "mod" end
+Bits.__pow = function(a, b) return "pow" end
+local bits = setmetatable({}, Bits)
+print(bits & 1, 1 | bits, bits ~ bits, bits << 1, bits >> 1, ~bits)
+print(bits // 2, bits / 2, bits % 2, 2 ^ bits)
+
+local first = setmetatable({}, {__add = function() return "first" end})
+local second = setmetatable({}, {__add = function() return "second" end})
+print(first + second, second + first, 1 + second)
+
+local plain = setmetatable({}, {})
+print(#plain)
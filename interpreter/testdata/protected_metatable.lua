@@ -0,0 +1,4 @@
+local t = setmetatable({}, {__metatable = false})
+print(getmetatable(t))
+setmetatable(t, {})
+print("unreachable")
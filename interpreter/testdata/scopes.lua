@@ -0,0 +1,68 @@
+local a = 1
+do
+    local a = 2
+    print(a)
+    do
+        local a = 3
+        print(a)
+    end
+    print(a)
+end
+print(a)
+
+local x = 1
+local x = x + 1
+print(x)
+
+do
+    local hidden = "hidden"
+end
+local visible = "visible"
+print(visible, hidden)
+
+local v = "outer"
+local get
+do
+    local v = "inner"
+    get = function() return v end
+end
+print(get(), v)
+
+local before = 10
+do
+    local temporary = 5
+end
+local after = before + 1
+print(before, after)
+
+local function double(n)
+    do
+        local n = n * 2
+        return n
+    end
+end
+print(double(4))
+
+for i = 1, 2 do
+    do
+        local i = i * 10
+        print(i)
+    end
+    print(i)
+end
+
+local shadowed = "first"
+local function read()
+    return shadowed
+end
+local shadowed = "second"
+print(read(), shadowed)
+
+do
+    local first, second = "a", "b"
+    do
+        local second = "c"
+        print(first, second)
+    end
+    print(first, second)
+end
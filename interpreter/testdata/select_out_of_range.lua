@@ -0,0 +1 @@
+print(select(-3, 1, 2))
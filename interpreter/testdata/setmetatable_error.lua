@@ -0,0 +1 @@
+setmetatable({}, 1)
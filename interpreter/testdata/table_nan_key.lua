@@ -0,0 +1,2 @@
+local t = {}
+rawset(t, 0/0, 1)
@@ -0,0 +1,4 @@
+local t = {}
+t[1] = 1
+print(#t)
+t[nil] = 2
@@ -0,0 +1,38 @@
+local t = {}
+t[2] = "b"
+t[2] = "b2"
+t[1.0] = "a"
+print(t[1], t[2], #t)
+
+-- filling a table backwards moves the keys to the array part
+local filled = {}
+for i = 20, 1, -1 do filled[i] = i * 2 end
+print(#filled, filled[1], filled[20])
+
+-- removing the last values shrinks the length
+filled[20] = nil
+filled[19] = nil
+print(#filled)
+
+-- any border may be the length of a table with holes
+local holes = {1, 2, nil, 4}
+local border = #holes
+print(border == 2 or border == 4)
+
+local keys = {[1] = 5, 10, [3.5] = "float", [2^53] = "large"}
+print(keys[1], keys[3.5], keys[2^53], keys[9007199254740992])
+
+local packed = table.pack(1, nil, 3)
+print(packed.n, table.unpack(packed, 1, packed.n))
+print(#{n = 1}, #{})
+
+-- a rehash may leave the key following the array part in the hash part, appending it must not duplicate it
+local shrunk = {}
+for i = 1, 16 do shrunk[i] = i end
+shrunk[4] = nil
+for i = 6, 16 do shrunk[i] = nil end
+for _, key in ipairs({"a", "b", "c", "d", "e"}) do shrunk[key] = key end
+shrunk[5] = "new"
+local count = 0
+for key, value in pairs(shrunk) do count = count + 1 end
+print(count, shrunk[5])
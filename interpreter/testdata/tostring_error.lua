@@ -0,0 +1,2 @@
+local t = setmetatable({}, {__tostring = function() return 1 end})
+print(t)
@@ -0,0 +1 @@
+local x <unknown> = 1
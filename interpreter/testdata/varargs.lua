@@ -0,0 +1,50 @@
+local function count(...)
+    return select('#', ...)
+end
+print(count(), count(nil), count(1, nil, 3))
+
+local function pass(...)
+    return ...
+end
+print(pass(1, 2, 3))
+print(pass(1, 2, 3), "end")
+print((pass(1, 2, 3)))
+
+local function fixed(a, b, ...)
+    print(a, b, ...)
+    local x, y = ...
+    return x, y
+end
+print(fixed(1))
+print(fixed(1, 2, 3, 4, 5))
+
+print(select(2, "a", "b", "c"))
+print(select(-1, "a", "b", "c"))
+print(select(4, "a", "b", "c"))
+
+local function list(...)
+    return {...}
+end
+print(list(1, 2, 3))
+print({..., "main"})
+
+local packed = table.pack(pass("x", nil, "z"))
+print(packed.n, table.unpack(packed, 1, packed.n))
+print(table.unpack({"a", "b", "c"}, 2, 3))
+
+local function sum(...)
+    local total = 0
+    for i = 1, select('#', ...) do
+        total = total + select(i, ...)
+    end
+    return total
+end
+print(sum(1, 2, 3, 4))
+
+local function outer(...)
+    local inner = function(...)
+        return select('#', ...)
+    end
+    return inner(..., ...)
+end
+print(outer(1, 2))
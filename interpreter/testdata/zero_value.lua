@@ -0,0 +1,5 @@
+local t = {1, 2, 3}
+local z = zero()
+print(z, z == nil, not z, tostring(z))
+t[4] = z
+print(#t, t[4])
@@ -53,7 +53,7 @@ const (
 	Ampersand
 	Tilde
 	Pipe
-	RightShfit
+	RightShift
 	LeftShift
 	EscpaedSlash
 	Equal
@@ -150,9 +150,9 @@ func FromString(value string) (TokenType, error) {
 		return Tilde, nil
 	case "|":
 		return Pipe, nil
-	case "=<<":
-		return RightShfit, nil
-	case "=>>":
+	case ">>":
+		return RightShift, nil
+	case "<<":
 		return LeftShift, nil
 	case "//":
 		return EscpaedSlash, nil
@@ -358,7 +358,7 @@ func (l *Lexer) next() (Token, error) {
 		}
 		return Token{Type: Slash}, nil
 	case '%':
-		return Token{Type: Ampersand}, nil
+		return Token{Type: Percentage}, nil
 	case '^':
 		return Token{Type: Cirumflex}, nil
 	case '#':
@@ -388,12 +388,20 @@ func (l *Lexer) next() (Token, error) {
 		if ok {
 			return Token{Type: SmallerThan}, nil
 		}
+		ok = l.readIf('<')
+		if ok {
+			return Token{Type: LeftShift}, nil
+		}
 		return Token{Type: Smaller}, nil
 	case '>':
 		ok := l.readIf('=')
 		if ok {
 			return Token{Type: GreaterThan}, nil
 		}
+		ok = l.readIf('>')
+		if ok {
+			return Token{Type: RightShift}, nil
+		}
 		return Token{Type: Greater}, nil
 	case '(':
 		return Token{Type: OpenBracket}, nil
@@ -595,7 +603,7 @@ func (l *Lexer) readString() (string, error) {
 
 func (l *Lexer) readIdentifier() string {
 	l.readWhile(func(next rune) bool {
-		return unicode.IsDigit(next) || unicode.IsLetter(next)
+		return unicode.IsDigit(next) || unicode.IsLetter(next) || next == '_'
 	})
 
 	return l.takeBuffer()
@@ -52,6 +52,50 @@ func Test(t *testing.T) {
 			},
 			wantErr: assert.NoError,
 		},
+		{
+			desc:  "7 % 2 // 1",
+			input: "7 % 2 // 1",
+			want: []Token{
+				{Type: Integer, Integer: 7},
+				{Type: Percentage},
+				{Type: Integer, Integer: 2},
+				{Type: EscpaedSlash},
+				{Type: Integer, Integer: 1},
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:  "1 << 2 >> 3 <= 4 >= 5 & 6 | 7 ~ 8",
+			input: "1 << 2 >> 3 <= 4 >= 5 & 6 | 7 ~ 8",
+			want: []Token{
+				{Type: Integer, Integer: 1},
+				{Type: LeftShift},
+				{Type: Integer, Integer: 2},
+				{Type: RightShift},
+				{Type: Integer, Integer: 3},
+				{Type: SmallerThan},
+				{Type: Integer, Integer: 4},
+				{Type: GreaterThan},
+				{Type: Integer, Integer: 5},
+				{Type: Ampersand},
+				{Type: Integer, Integer: 6},
+				{Type: Pipe},
+				{Type: Integer, Integer: 7},
+				{Type: Tilde},
+				{Type: Integer, Integer: 8},
+			},
+			wantErr: assert.NoError,
+		},
+		{
+			desc:  "__index = _G",
+			input: "__index = _G",
+			want: []Token{
+				{Type: Identifier, Str: "__index"},
+				{Type: Assign},
+				{Type: Identifier, Str: "_G"},
+			},
+			wantErr: assert.NoError,
+		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
@@ -41,7 +41,7 @@ func _() {
 	_ = x[Ampersand-31]
 	_ = x[Tilde-32]
 	_ = x[Pipe-33]
-	_ = x[RightShfit-34]
+	_ = x[RightShift-34]
 	_ = x[LeftShift-35]
 	_ = x[EscpaedSlash-36]
 	_ = x[Equal-37]
@@ -70,7 +70,7 @@ func _() {
 	_ = x[Identifier-60]
 }
 
-const _TokenType_name = "AndBreakDoElseElseIfEndFalseForFunctionGlobalGotoIfInLocalNilNotOrRepeatReturnThenTrueUntilWhilePlusMinusAsteriskSlashPercentageCirumflexHashtagAmpersandTildePipeRightShfitLeftShiftEscpaedSlashEqualNotEqualSmallerThanGreaterThanSmallerGreaterAssignOpenBracketClosedBracketOpenBraceClosedBraceOpenSquareBracketClosedSquareBracketDoubleColonSemiColonColonCommaDotDoubleDotTrippleDotFloatIntegerStringIdentifier"
+const _TokenType_name = "AndBreakDoElseElseIfEndFalseForFunctionGlobalGotoIfInLocalNilNotOrRepeatReturnThenTrueUntilWhilePlusMinusAsteriskSlashPercentageCirumflexHashtagAmpersandTildePipeRightShiftLeftShiftEscpaedSlashEqualNotEqualSmallerThanGreaterThanSmallerGreaterAssignOpenBracketClosedBracketOpenBraceClosedBraceOpenSquareBracketClosedSquareBracketDoubleColonSemiColonColonCommaDotDoubleDotTrippleDotFloatIntegerStringIdentifier"
 
 var _TokenType_index = [...]uint16{0, 3, 8, 10, 14, 20, 23, 28, 31, 39, 45, 49, 51, 53, 58, 61, 64, 66, 72, 78, 82, 86, 91, 96, 100, 105, 113, 118, 128, 137, 144, 153, 158, 162, 172, 181, 193, 198, 206, 217, 228, 235, 242, 248, 259, 272, 281, 292, 309, 328, 339, 348, 353, 358, 361, 370, 380, 385, 392, 398, 408}
 
@@ -20,11 +20,16 @@ func _() {
 	_ = x[expressionIndexInt-9]
 	_ = x[expressionCall-10]
 	_ = x[expressionUnaryOperation-11]
+	_ = x[expressionBinaryOperation-12]
+	_ = x[expressionFunction-13]
+	_ = x[expressionUpvalue-14]
+	_ = x[expressionVararg-15]
+	_ = x[expressionConcat-16]
 }
 
-const _expressionType_name = "NilexpressioinBooleanIntegerFloatStringLocalGlobalIndexIndexFieldIndexIntCallUnaryOperation"
+const _expressionType_name = "NilexpressioinBooleanIntegerFloatStringLocalGlobalIndexIndexFieldIndexIntCallUnaryOperationBinaryOperationFunctionUpvalueVarargConcat"
 
-var _expressionType_index = [...]uint8{0, 3, 21, 28, 33, 39, 44, 50, 55, 65, 73, 77, 91}
+var _expressionType_index = [...]uint8{0, 3, 21, 28, 33, 39, 44, 50, 55, 65, 73, 77, 91, 106, 114, 121, 127, 133}
 
 func (i expressionType) String() string {
 	idx := int(i) - 0
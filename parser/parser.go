@@ -7,6 +7,7 @@ import (
 	"luingo/lexer"
 	"luingo/vm"
 	"math"
+	"slices"
 )
 
 type Error struct {
@@ -29,63 +30,893 @@ func (e *Error) Unwrap() error {
 }
 
 type Parser struct {
-	lexer        lexer.Lexer
-	constants    *constantTable
-	byteCodes    []vm.ByteCode
-	locals       []string
-	localsIndex  map[string]byte
-	stackPointer byte
+	lexer lexer.Lexer
+	*functionState
+}
+
+// functionState holds the compile state of the function which is currently parsed. Nested functions get
+// their own state, the state of the enclosing function is restored once they end.
+type functionState struct {
+	parent         *functionState
+	constants      *constantTable
+	byteCodes      []vm.ByteCode
+	prototypes     []*vm.Prototype
+	parameterCount byte
+	isVararg       bool
+	upvalues       []vm.UpvalueDescriptor
+	upvaluesIndex  map[string]byte
+	locals         []localVariable
+	stackPointer   byte
+	maxStackSize   int
+	loops          []loop
+	scopes         []scope
+	labels         []label
+	gotos          []pendingGoto
+}
+
+func newFunctionState(parent *functionState) *functionState {
+	return &functionState{
+		parent:        parent,
+		constants:     newConstantTable(),
+		upvaluesIndex: map[string]byte{},
+	}
+}
+
+// newMainFunctionState returns the state of the main function, which receives the script arguments as '...'.
+func newMainFunctionState() *functionState {
+	state := newFunctionState(nil)
+	state.isVararg = true
+	return state
+}
+
+// localVariable is a local of the function, captured is set once a nested function refers to it.
+type localVariable struct {
+	name      string
+	attribute localAttribute
+	captured  bool
+	// constant is the literal value of a const local, which is inlined instead of being stored on the stack.
+	constant *expression
+}
+
+// localAttribute restricts how a local can be used. Const locals can not be assigned to, close locals
+// can not be assigned to either and their value is closed once they go out of scope.
+type localAttribute byte
+
+const (
+	attributeNone localAttribute = iota
+	attributeConst
+	attributeClose
+)
+
+// needsClose reports whether the Close byte code has to be executed when the local goes out of scope.
+func (l localVariable) needsClose() bool {
+	return l.captured || l.attribute == attributeClose
+}
+
+// prototype returns the compiled function.
+func (f *functionState) prototype() *vm.Prototype {
+	return &vm.Prototype{
+		Constants:      f.constants.constants,
+		ByteCodes:      f.byteCodes,
+		Prototypes:     f.prototypes,
+		ParameterCount: f.parameterCount,
+		IsVararg:       f.isVararg,
+		Upvalues:       f.upvalues,
+		MaxStackSize:   f.maxStackSize,
+	}
+}
+
+// upvalue returns the index of the upvalue referring to the variable name of an enclosing function. The
+// upvalue is added to the function and all functions in between if it does not exist yet. It reports
+// false if no enclosing function has a local with the name.
+func (f *functionState) upvalue(name string) (byte, bool) {
+	if index, ok := f.upvaluesIndex[name]; ok {
+		return index, true
+	}
+	if f.parent == nil {
+		return 0, false
+	}
+
+	var descriptor vm.UpvalueDescriptor
+	if localIndex, ok := f.parent.findLocal(name); ok {
+		f.parent.captureLocal(localIndex)
+		descriptor = vm.UpvalueDescriptor{InStack: true, Index: localIndex}
+	} else {
+		upvalueIndex, ok := f.parent.upvalue(name)
+		if !ok {
+			return 0, false
+		}
+		descriptor = vm.UpvalueDescriptor{InStack: false, Index: upvalueIndex}
+	}
+
+	f.upvalues = append(f.upvalues, descriptor)
+	index := byte(len(f.upvalues) - 1)
+	f.upvaluesIndex[name] = index
+	return index, true
+}
+
+// findLocal returns the index of the innermost local with the name which is in scope.
+func (f *functionState) findLocal(name string) (byte, bool) {
+	for i := len(f.locals) - 1; i >= 0; i-- {
+		if f.locals[i].name == name {
+			return byte(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// captureLocal marks the local as captured, its upvalue has to be closed when the local goes out of scope.
+func (f *functionState) captureLocal(index byte) {
+	f.locals[index].captured = true
+	f.closeInLoops(index)
+}
+
+// closeInLoops marks the loops declaring the local, breaks out of them have to close it.
+func (f *functionState) closeInLoops(index byte) {
+	for i := range f.loops {
+		if int(index) >= f.loops[i].localsCount {
+			f.loops[i].needsClose = true
+		}
+	}
+}
+
+// readOnly reports whether the variable name refers to a const or close local, which can not be assigned to.
+func (f *functionState) readOnly(name string) bool {
+	for function := f; function != nil; function = function.parent {
+		if index, ok := function.findLocal(name); ok {
+			return function.locals[index].attribute != attributeNone
+		}
+	}
+
+	return false
+}
+
+// constant returns the inlined value if the variable name refers to a const local with a literal value.
+func (f *functionState) constant(name string) (expression, bool) {
+	for function := f; function != nil; function = function.parent {
+		if index, ok := function.findLocal(name); ok {
+			local := function.locals[index]
+			if local.constant == nil {
+				return expression{}, false
+			}
+			return *local.constant, true
+		}
+	}
+
+	return expression{}, false
+}
+
+// growStack records that the function uses at least size stack slots.
+func (f *functionState) growStack(size int) {
+	f.maxStackSize = max(f.maxStackSize, size)
+}
+
+// loop collects the break statements of a loop which are patched to jump behind the loop once it ends.
+// localsCount is the number of locals declared outside of the loop. If a nested function captures a local
+// of the loop or the loop declares a close local, needsClose is set and breaks have to close them.
+type loop struct {
+	breakJumps  []int
+	localsCount int
+	needsClose  bool
+}
+
+// scope is a block of the function which is currently parsed. localsCount, labelsCount and gotosCount are
+// the numbers of locals, visible labels and pending gotos when the block started, everything added
+// afterwards belongs to the block and goes out of scope when it ends.
+type scope struct {
+	localsCount int
+	labelsCount int
+	gotosCount  int
+}
+
+// label is a visible label. Gotos jumping to it must not enter the scope of the locals from localsCount on.
+type label struct {
+	name          string
+	byteCodeIndex int
+	localsCount   int
+	cursor        lexer.Cursor
+}
+
+// pendingGoto is a goto whose label is not defined yet. close is set once it leaves a block whose locals
+// are captured, their upvalues are closed at the label.
+type pendingGoto struct {
+	name        string
+	jumpIndex   int
+	localsCount int
+	close       bool
+	cursor      lexer.Cursor
 }
 
 func NewParser(input string) *Parser {
 	return &Parser{
-		lexer:       *lexer.NewLexer(input),
-		constants:   newConstantTable(),
-		localsIndex: map[string]byte{},
+		lexer:         *lexer.NewLexer(input),
+		functionState: newMainFunctionState(),
+	}
+}
+
+// Parse compiles the input into the prototype of the main function.
+func (p *Parser) Parse() (*vm.Prototype, error) {
+	if err := p.scopedBlock(); err != nil {
+		return nil, err
+	}
+
+	if token, err := p.lexer.Next(); err == nil {
+		return nil, p.newError(fmt.Errorf("did not expect token '%v'", token.Type.String()))
+	}
+
+	p.byteCodes = append(p.byteCodes, vm.Return(0, 0))
+	prototype := p.prototype()
+	p.functionState = newMainFunctionState()
+
+	return prototype, nil
+}
+
+// block parses statements until the end of the input or a token which closes a block. The closing token
+// is not consumed.
+func (p *Parser) block() error {
+	for {
+		token, err := p.lexer.Peek()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return fmt.Errorf("reading next token: %w", err)
+		}
+
+		if isBlockEnd(token.Type) {
+			return nil
+		}
+
+		p.lexer.Next()
+		if err := p.statement(token); err != nil {
+			return err
+		}
+		// the constants are added without checking their number, a statement exceeding it is rejected as a whole
+		if p.constants.overflow {
+			return p.newError(fmt.Errorf("too many constants (limit is %v)", math.MaxUint8+1))
+		}
+
+		p.stackPointer = byte(len(p.locals))
+	}
+}
+
+// scopedBlock parses a block whose locals are not visible after it ends.
+func (p *Parser) scopedBlock() error {
+	p.enterScope()
+	if err := p.block(); err != nil {
+		return err
+	}
+
+	return p.leaveScope()
+}
+
+// enterScope starts a block. The locals, labels and gotos added until leaveScope belong to the block.
+func (p *Parser) enterScope() {
+	p.scopes = append(p.scopes, scope{len(p.locals), len(p.labels), len(p.gotos)})
+}
+
+// leaveScope ends the innermost block. Its locals and labels go out of scope, its pending gotos may still
+// jump to a label of an enclosing block unless it is the outermost block of the function.
+func (p *Parser) leaveScope() error {
+	var current scope
+	p.scopes, current, _ = pop(p.scopes)
+	p.labels = p.labels[:current.labelsCount]
+
+	needsClose := p.needsClose(p.locals[current.localsCount:])
+	for i := current.gotosCount; i < len(p.gotos); i++ {
+		p.gotos[i].localsCount = min(p.gotos[i].localsCount, current.localsCount)
+		p.gotos[i].close = p.gotos[i].close || needsClose
+	}
+
+	if len(p.scopes) == 0 {
+		if len(p.gotos) > 0 {
+			pending := p.gotos[0]
+			return &Error{fmt.Errorf("no visible label '%v' for goto", pending.name), pending.cursor}
+		}
+
+		// returning from the function closes the upvalues anyway
+		p.locals = p.locals[:current.localsCount]
+		return nil
+	}
+
+	p.releaseLocals(current.localsCount)
+	return nil
+}
+
+// releaseLocals removes all but the first count locals, uncovering locals they have shadowed, and frees
+// their stack slots. The upvalues of released locals captured by closures and released close locals are
+// closed.
+func (p *Parser) releaseLocals(count int) {
+	released := p.locals[count:]
+	p.locals = p.locals[:count]
+	p.stackPointer = byte(count)
+
+	if p.needsClose(released) {
+		p.byteCodes = append(p.byteCodes, vm.Close(byte(count)))
+	}
+}
+
+func (p *Parser) needsClose(locals []localVariable) bool {
+	return slices.ContainsFunc(locals, localVariable.needsClose)
+}
+
+func (p *Parser) statement(token lexer.Token) error {
+	switch token.Type {
+	case lexer.SemiColon:
+
+	case lexer.OpenBracket:
+		fallthrough
+	case lexer.Identifier:
+
+		prefixExp, err := p.prefixExp(token)
+		if err != nil {
+			return fmt.Errorf("parsing prefixexp: %w", err)
+		}
+		if prefixExp.expressionType == expressionCall {
+			p.setResultCount(prefixExp, 0)
+		} else if err := p.checkAssignable(token, prefixExp); err != nil {
+			return err
+		} else if err := p.assignment(prefixExp); err != nil {
+			return fmt.Errorf("parsing assignment: %w", err)
+		}
+
+	case lexer.Local:
+		peeked, err := p.lexer.Peek()
+		if err != nil {
+			return err
+		}
+		if peeked.Type == lexer.Function {
+			p.lexer.Next()
+			if err := p.localFunction(); err != nil {
+				return fmt.Errorf("parsing local function: %w", err)
+			}
+		} else if err := p.local(); err != nil {
+			return fmt.Errorf("parsing local statement: %w", err)
+		}
+
+	case lexer.Function:
+		if err := p.functionStatement(); err != nil {
+			return fmt.Errorf("parsing function statement: %w", err)
+		}
+
+	case lexer.If:
+		if err := p.ifStatement(); err != nil {
+			return fmt.Errorf("parsing if statement: %w", err)
+		}
+
+	case lexer.While:
+		if err := p.whileStatement(); err != nil {
+			return fmt.Errorf("parsing while statement: %w", err)
+		}
+
+	case lexer.Repeat:
+		if err := p.repeatStatement(); err != nil {
+			return fmt.Errorf("parsing repeat statement: %w", err)
+		}
+
+	case lexer.For:
+		if err := p.forStatement(); err != nil {
+			return fmt.Errorf("parsing for statement: %w", err)
+		}
+
+	case lexer.Return:
+		if err := p.returnStatement(); err != nil {
+			return fmt.Errorf("parsing return statement: %w", err)
+		}
+
+	case lexer.Do:
+		if err := p.scopedBlock(); err != nil {
+			return fmt.Errorf("parsing do block: %w", err)
+		}
+		if _, err := p.lexer.ExpectToken(lexer.End); err != nil {
+			return err
+		}
+
+	case lexer.Goto:
+		if err := p.gotoStatement(); err != nil {
+			return fmt.Errorf("parsing goto statement: %w", err)
+		}
+
+	case lexer.DoubleColon:
+		if err := p.labelStatement(); err != nil {
+			return fmt.Errorf("parsing label: %w", err)
+		}
+
+	case lexer.Break:
+		if len(p.loops) == 0 {
+			return p.newError(errors.New("break outside a loop"))
+		}
+		p.byteCodes = append(p.byteCodes, vm.Jump(0))
+		currentLoop := &p.loops[len(p.loops)-1]
+		currentLoop.breakJumps = append(currentLoop.breakJumps, len(p.byteCodes)-1)
+
+	default:
+		return p.newError(fmt.Errorf("did not expect token '%v'", token.Type.String()))
+	}
+
+	return nil
+}
+
+// gotoStatement jumps to a visible label. Backward jumps are resolved right away, forward jumps are
+// resolved once the label is defined.
+func (p *Parser) gotoStatement() error {
+	cursor := p.lexer.Cursor()
+	name, err := p.lexer.ExpectToken(lexer.Identifier)
+	if err != nil {
+		return err
+	}
+
+	if target, ok := p.findLabel(name.Str); ok {
+		if len(p.locals) > target.localsCount {
+			// the jump leaves the scope of locals which may be captured or closed
+			p.byteCodes = append(p.byteCodes, vm.Close(byte(target.localsCount)))
+		}
+		return p.jumpTo(target.byteCodeIndex)
+	}
+
+	p.byteCodes = append(p.byteCodes, vm.Jump(0))
+	p.gotos = append(p.gotos, pendingGoto{
+		name:        name.Str,
+		jumpIndex:   len(p.byteCodes) - 1,
+		localsCount: len(p.locals),
+		cursor:      cursor,
+	})
+	return nil
+}
+
+// labelStatement defines a label and resolves the pending gotos of the current block jumping to it.
+func (p *Parser) labelStatement() error {
+	cursor := p.lexer.Cursor()
+	name, err := p.lexer.ExpectToken(lexer.Identifier)
+	if err != nil {
+		return err
+	}
+	if _, err := p.lexer.ExpectToken(lexer.DoubleColon); err != nil {
+		return err
+	}
+
+	if existing, ok := p.findLabel(name.Str); ok {
+		return &Error{fmt.Errorf("label '%v' already defined at %+v", name.Str, existing.cursor), cursor}
+	}
+	// the label is registered before the labels following it, its position is set once they are parsed
+	labelIndex := len(p.labels)
+	p.labels = append(p.labels, label{name: name.Str, cursor: cursor})
+
+	// void statements following the label do not count as its block's content
+	peeked, err := p.lexer.Peek()
+	for err == nil && (peeked.Type == lexer.SemiColon || peeked.Type == lexer.DoubleColon) {
+		p.lexer.Next()
+		if err := p.statement(peeked); err != nil {
+			return err
+		}
+		peeked, err = p.lexer.Peek()
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	current := p.scopes[len(p.scopes)-1]
+	newLabel := label{name: name.Str, byteCodeIndex: len(p.byteCodes), localsCount: len(p.locals), cursor: cursor}
+	if errors.Is(err, io.EOF) || peeked.Type == lexer.End || peeked.Type == lexer.Else || peeked.Type == lexer.ElseIf {
+		// the scope of the block's locals ends at a label which is the last statement of the block
+		newLabel.localsCount = current.localsCount
+	}
+
+	closeUpvalues := false
+	pending := p.gotos[current.gotosCount:]
+	for i := 0; i < len(pending); i++ {
+		if pending[i].name != newLabel.name {
+			continue
+		}
+
+		jump := pending[i]
+		if jump.localsCount < newLabel.localsCount {
+			local := p.locals[jump.localsCount].name
+			return &Error{fmt.Errorf("goto '%v' jumps into the scope of local '%v'", newLabel.name, local), cursor}
+		}
+		if err := p.patchJumpTo(jump.jumpIndex, newLabel.byteCodeIndex); err != nil {
+			return err
+		}
+		closeUpvalues = closeUpvalues || jump.close || p.needsClose(p.locals[newLabel.localsCount:min(jump.localsCount, len(p.locals))])
+
+		pending = slices.Delete(pending, i, i+1)
+		i--
+	}
+	p.gotos = p.gotos[:current.gotosCount+len(pending)]
+
+	if closeUpvalues {
+		p.byteCodes = append(p.byteCodes, vm.Close(byte(newLabel.localsCount)))
+	}
+
+	p.labels[labelIndex] = newLabel
+	return nil
+}
+
+// findLabel returns the label with the name if it is visible in the current block.
+func (p *Parser) findLabel(name string) (label, bool) {
+	for _, visible := range p.labels {
+		if visible.name == name {
+			return visible, true
+		}
+	}
+
+	return label{}, false
+}
+
+func (p *Parser) ifStatement() error {
+	var endJumps []int
+	for {
+		condition, err := p.readExpression()
+		if err != nil {
+			return err
+		}
+		if _, err := p.lexer.ExpectToken(lexer.Then); err != nil {
+			return err
+		}
+
+		falseJump, err := p.jumpIfFalse(condition)
+		if err != nil {
+			return err
+		}
+		p.stackPointer = byte(len(p.locals))
+
+		if err := p.scopedBlock(); err != nil {
+			return err
+		}
+
+		token, err := p.lexer.Next()
+		if err != nil {
+			return err
+		}
+
+		switch token.Type {
+		case lexer.ElseIf, lexer.Else:
+			p.byteCodes = append(p.byteCodes, vm.Jump(0))
+			endJumps = append(endJumps, len(p.byteCodes)-1)
+		case lexer.End:
+		default:
+			return p.newError(fmt.Errorf("did not expect token '%v' in if statement", token.Type))
+		}
+
+		if err := p.patchJump(falseJump); err != nil {
+			return err
+		}
+
+		if token.Type == lexer.ElseIf {
+			continue
+		}
+
+		if token.Type == lexer.Else {
+			if err := p.scopedBlock(); err != nil {
+				return err
+			}
+			if _, err := p.lexer.ExpectToken(lexer.End); err != nil {
+				return err
+			}
+		}
+
+		break
+	}
+
+	for _, endJump := range endJumps {
+		if err := p.patchJump(endJump); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Parser) whileStatement() error {
+	start := len(p.byteCodes)
+
+	condition, err := p.readExpression()
+	if err != nil {
+		return err
+	}
+	if _, err := p.lexer.ExpectToken(lexer.Do); err != nil {
+		return err
+	}
+
+	exitJump, err := p.jumpIfFalse(condition)
+	if err != nil {
+		return err
+	}
+	p.stackPointer = byte(len(p.locals))
+
+	p.enterLoop()
+	if err := p.scopedBlock(); err != nil {
+		return err
+	}
+	if _, err := p.lexer.ExpectToken(lexer.End); err != nil {
+		return err
+	}
+
+	if err := p.jumpTo(start); err != nil {
+		return err
+	}
+	if err := p.patchJump(exitJump); err != nil {
+		return err
+	}
+
+	return p.leaveLoop()
+}
+
+func (p *Parser) forStatement() error {
+	name, err := p.lexer.ExpectToken(lexer.Identifier)
+	if err != nil {
+		return err
+	}
+
+	token, err := p.lexer.Next()
+	if err != nil {
+		return err
+	}
+
+	switch token.Type {
+	case lexer.Assign:
+		return p.numericFor(name.Str)
+	case lexer.Comma, lexer.In:
+		names := []string{name.Str}
+		for token.Type == lexer.Comma {
+			name, err := p.lexer.ExpectToken(lexer.Identifier)
+			if err != nil {
+				return err
+			}
+			names = append(names, name.Str)
+
+			token, err = p.lexer.Next()
+			if err != nil {
+				return err
+			}
+		}
+		if token.Type != lexer.In {
+			return p.newError(fmt.Errorf("want %v got %v", lexer.In, token.Type))
+		}
+
+		return p.genericFor(names)
+	default:
+		return p.newError(fmt.Errorf("did not expect token '%v' in for statement", token.Type))
+	}
+}
+
+// numericFor parses the rest of a numeric for loop. The initial value, limit and step are stored in three
+// hidden locals followed by the loop variable, which the loop byte codes update on every iteration.
+func (p *Parser) numericFor(name string) error {
+	base := byte(len(p.locals))
+
+	initial, err := p.readExpression()
+	if err != nil {
+		return err
+	}
+	p.loadExpression(base, initial)
+
+	if _, err := p.lexer.ExpectToken(lexer.Comma); err != nil {
+		return err
+	}
+	limit, err := p.readExpression()
+	if err != nil {
+		return err
+	}
+	p.loadExpression(base+1, limit)
+
+	step := newIntegerExpression(1)
+	peeked, err := p.lexer.Peek()
+	if err != nil {
+		return err
+	}
+	if peeked.Type == lexer.Comma {
+		p.lexer.Next()
+		step, err = p.readExpression()
+		if err != nil {
+			return err
+		}
+	}
+	p.loadExpression(base+2, step)
+
+	if _, err := p.lexer.ExpectToken(lexer.Do); err != nil {
+		return err
+	}
+
+	p.enterScope()
+	for range 3 {
+		if err := p.addLocal(forStateName); err != nil {
+			return err
+		}
+	}
+
+	p.byteCodes = append(p.byteCodes, vm.ForPrepare(base, 0))
+	prepareIndex := len(p.byteCodes) - 1
+
+	p.enterLoop()
+	if err := p.loopBody(name); err != nil {
+		return err
+	}
+
+	loopOffset, err := p.jumpOffset(len(p.byteCodes), prepareIndex+1)
+	if err != nil {
+		return err
+	}
+	p.byteCodes = append(p.byteCodes, vm.ForLoop(base, loopOffset))
+
+	skipOffset, err := p.jumpOffset(prepareIndex, len(p.byteCodes))
+	if err != nil {
+		return err
+	}
+	p.byteCodes[prepareIndex] = vm.ForPrepare(base, skipOffset)
+
+	if err := p.leaveLoop(); err != nil {
+		return err
+	}
+
+	return p.leaveScope()
+}
+
+// loopBody parses the body of a for loop, which shares its scope with the loop variables.
+func (p *Parser) loopBody(names ...string) error {
+	p.enterScope()
+	for _, name := range names {
+		if err := p.addLocal(name); err != nil {
+			return err
+		}
+	}
+	p.stackPointer = byte(len(p.locals))
+
+	if err := p.block(); err != nil {
+		return err
+	}
+	if _, err := p.lexer.ExpectToken(lexer.End); err != nil {
+		return err
+	}
+
+	return p.leaveScope()
+}
+
+// genericFor parses the rest of a generic for loop. The expression list is adjusted to the iterator
+// function, state, control value and closing value which are stored in four hidden locals followed by
+// the loop variables.
+func (p *Parser) genericFor(names []string) error {
+	base := byte(len(p.locals))
+	p.stackPointer = base
+
+	valueCount, last, err := p.expList()
+	if err != nil {
+		return err
+	}
+	p.adjustValues(base+valueCount-1, last, 4-int(valueCount-1))
+
+	if _, err := p.lexer.ExpectToken(lexer.Do); err != nil {
+		return err
+	}
+
+	p.enterScope()
+	for range 4 {
+		if err := p.addLocal(forStateName); err != nil {
+			return err
+		}
+	}
+	// the closing value is closed when the loop ends
+	p.locals[base+3].attribute = attributeClose
+	// the iterator is called with copies of its function, state and control value behind the hidden locals
+	p.growStack(int(base) + 7)
+
+	p.byteCodes = append(p.byteCodes, vm.GenericForPrepare(base, 0))
+	prepareIndex := len(p.byteCodes) - 1
+
+	p.enterLoop()
+	if err := p.loopBody(names...); err != nil {
+		return err
+	}
+
+	callOffset, err := p.jumpOffset(prepareIndex, len(p.byteCodes))
+	if err != nil {
+		return err
+	}
+	p.byteCodes[prepareIndex] = vm.GenericForPrepare(base, callOffset)
+	p.byteCodes = append(p.byteCodes, vm.GenericForCall(base, byte(len(names))))
+
+	loopOffset, err := p.jumpOffset(len(p.byteCodes), prepareIndex+1)
+	if err != nil {
+		return err
+	}
+	p.byteCodes = append(p.byteCodes, vm.GenericForLoop(base, loopOffset))
+
+	if err := p.leaveLoop(); err != nil {
+		return err
+	}
+
+	return p.leaveScope()
+}
+
+// repeatStatement parses a repeat-until loop. The condition is part of the loop body's scope, so it can
+// access the locals declared inside the loop.
+func (p *Parser) repeatStatement() error {
+	start := len(p.byteCodes)
+	localsCount := len(p.locals)
+
+	p.enterLoop()
+	p.enterScope()
+	if err := p.block(); err != nil {
+		return err
+	}
+	if _, err := p.lexer.ExpectToken(lexer.Until); err != nil {
+		return err
+	}
+
+	condition, err := p.readExpression()
+	if err != nil {
+		return err
+	}
+	repeatJump, err := p.jumpIfFalse(condition)
+	if err != nil {
+		return err
+	}
+	if p.needsClose(p.locals[localsCount:]) {
+		// every iteration has its own locals, so they have to be closed before repeating
+		p.byteCodes = append(p.byteCodes, vm.Jump(0))
+		exitJump := len(p.byteCodes) - 1
+		if err := p.patchJump(repeatJump); err != nil {
+			return err
+		}
+		p.byteCodes = append(p.byteCodes, vm.Close(byte(localsCount)), vm.Jump(0))
+		repeatJump = len(p.byteCodes) - 1
+		if err := p.patchJump(exitJump); err != nil {
+			return err
+		}
+	}
+	if err := p.patchJumpTo(repeatJump, start); err != nil {
+		return err
 	}
+	if err := p.leaveScope(); err != nil {
+		return err
+	}
+
+	return p.leaveLoop()
 }
 
-func (p *Parser) Parse() ([]vm.Value, []vm.ByteCode, error) {
-	for {
-		token, err := p.lexer.Next()
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
+func (p *Parser) enterLoop() {
+	p.loops = append(p.loops, loop{localsCount: len(p.locals)})
+}
 
-			return nil, nil, fmt.Errorf("reading next token: %w", err)
-		}
+// leaveLoop lets all breaks of the innermost loop jump to the next byte code that will be emitted.
+func (p *Parser) leaveLoop() error {
+	var currentLoop loop
+	p.loops, currentLoop, _ = pop(p.loops)
 
-		switch token.Type {
-		case lexer.SemiColon:
+	for _, breakJump := range currentLoop.breakJumps {
+		if err := p.patchJump(breakJump); err != nil {
+			return err
+		}
+	}
 
-		case lexer.OpenBracket:
-			fallthrough
-		case lexer.Identifier:
+	if len(currentLoop.breakJumps) > 0 && currentLoop.needsClose {
+		// breaks leave the scope of captured and close locals, they are closed at the jump target
+		p.byteCodes = append(p.byteCodes, vm.Close(byte(currentLoop.localsCount)))
+	}
 
-			prefixExp, err := p.prefixExp(token)
-			if err != nil {
-				return nil, nil, fmt.Errorf("parsing prefixexp: %w", err)
-			}
-			if prefixExp.expressionType != expressionCall {
-				p.assignment(prefixExp)
-			}
+	return nil
+}
 
-		case lexer.Local:
-			if err := p.local(); err != nil {
-				return nil, nil, fmt.Errorf("parsing local statement: %w", err)
-			}
-		default:
-			return nil, nil, p.newError(fmt.Errorf("did not expect token '%v'", token.Type.String()))
+// jumpIfFalse emits a jump which is executed if the condition is false and returns its index. A condition
+// which is always true needs no jump, noJump is returned instead.
+func (p *Parser) jumpIfFalse(condition expression) (int, error) {
+	if condition.isConst() {
+		if condition.isTruthy() {
+			return noJump, nil
 		}
-
-		p.stackPointer = byte(len(p.locals))
+		p.byteCodes = append(p.byteCodes, vm.Jump(0))
+		return len(p.byteCodes) - 1, nil
 	}
 
-	constants, byteCodes := p.constants.constants, p.byteCodes
-	p.constants, p.byteCodes = newConstantTable(), nil
+	stackIndex, err := p.loadExpTop(condition)
+	if err != nil {
+		return 0, err
+	}
 
-	return constants, byteCodes, nil
+	p.byteCodes = append(p.byteCodes, vm.Test(stackIndex, false), vm.Jump(0))
+	return len(p.byteCodes) - 1, nil
 }
 
 func (p *Parser) assignment(firstVariable expression) error {
@@ -107,6 +938,9 @@ loop:
 			if err != nil {
 				return err
 			}
+			if err := p.checkAssignable(token, expression); err != nil {
+				return err
+			}
 			varList = append(varList, expression)
 
 		case lexer.Assign:
@@ -118,43 +952,21 @@ loop:
 	}
 
 	stackPointer := p.stackPointer
-	var expListSize byte = 0
-	var lastExpression expression
-
-	for {
-		var err error
-		lastExpression, err = p.readExpression()
-		if err != nil {
-			return err
-		}
-
-		peeked, err := p.lexer.Peek()
-		if err != nil {
-			return err
-		}
-
-		if peeked.Type != lexer.Comma {
-			break
-		}
-
-		p.lexer.Next()
-		p.loadExpression(stackPointer+expListSize, lastExpression)
-		expListSize++
+	expListSize, lastExpression, err := p.expList()
+	if err != nil {
+		return err
 	}
 
-	if expListSize+1 == byte(len(varList)) {
+	if expListSize == byte(len(varList)) {
 		lastVar := varList[len(varList)-1]
 		varList = varList[:len(varList)-1]
+		expListSize--
 		if err := p.assignVariable(lastVar, lastExpression); err != nil {
 			return err
 		}
-	} else if expListSize+1 > byte(len(varList)) {
-		expListSize = byte(len(varList))
 	} else {
-		nilExpressions := byte(len(varList)) - expListSize + 1
-		for i := range nilExpressions {
-			p.loadExpression(stackPointer+expListSize+1+i, newNilExpression())
-		}
+		p.adjustValues(stackPointer+expListSize-1, lastExpression, len(varList)-int(expListSize-1))
+		expListSize = byte(len(varList))
 	}
 
 	for len(varList) > 0 {
@@ -185,10 +997,30 @@ func pop[T any](s []T) ([]T, T, bool) {
 	return s, last, true
 }
 
+// checkAssignable returns an error if the assignment target read from the token is a const or close local.
+func (p *Parser) checkAssignable(token lexer.Token, target expression) error {
+	switch target.expressionType {
+	case expressionIndex, expressionIndexField, expressionIndexInt:
+		// fields of the local's value can be assigned to
+		return nil
+	}
+
+	if token.Type == lexer.Identifier && p.readOnly(token.Str) {
+		return p.newError(fmt.Errorf("attempt to assign to const variable '%v'", token.Str))
+	}
+	return nil
+}
+
 func (p *Parser) assignVariable(variable, value expression) error {
 	switch variable.expressionType {
 	case expressionLocal:
 		p.loadExpression(variable.inner.(byte), value)
+	case expressionUpvalue:
+		stackIndex, err := p.loadExpTop(value)
+		if err != nil {
+			return err
+		}
+		return p.assignVariableLocal(variable, stackIndex)
 	default:
 		index, isConst, err := p.addConstOrLoadExp(value)
 		if err != nil {
@@ -212,6 +1044,9 @@ func (p *Parser) assignVariableLocal(variable expression, stackIndex byte) error
 	case expressionGlobal:
 		p.byteCodes = append(p.byteCodes, vm.SetGlobal(variable.inner.(byte), stackIndex))
 
+	case expressionUpvalue:
+		p.byteCodes = append(p.byteCodes, vm.SetUpvalue(variable.inner.(byte), stackIndex))
+
 	case expressionIndex:
 		pair := variable.inner.([2]byte)
 		p.byteCodes = append(p.byteCodes, vm.SetTable(pair[0], pair[1], stackIndex))
@@ -256,20 +1091,37 @@ func (p *Parser) assignVariableConst(variable expression, constIndex byte) error
 }
 
 func (p *Parser) local() error {
-	var variables []string
-	var valuesSize byte
+	var variables []localVariable
+	var (
+		valuesSize byte
+		last       expression
+	)
+	closeIndex := -1
 loop:
 	for {
 		token, err := p.lexer.ExpectToken(lexer.Identifier)
 		if err != nil {
 			return err
 		}
-		variables = append(variables, token.Str)
+		attribute, err := p.localAttribute()
+		if err != nil {
+			return err
+		}
+		if attribute == attributeClose {
+			if closeIndex >= 0 {
+				return p.newError(errors.New("multiple to-be-closed variables in local list"))
+			}
+			closeIndex = len(variables)
+		}
+		variables = append(variables, localVariable{name: token.Str, attribute: attribute})
 
 		peeked, err := p.lexer.Peek()
-		if err != nil {
+		if err != nil && !errors.Is(err, io.EOF) {
 			return err
 		}
+		if err != nil {
+			break
+		}
 
 		switch peeked.Type {
 		case lexer.Comma:
@@ -277,7 +1129,7 @@ loop:
 
 		case lexer.Assign:
 			p.lexer.Next()
-			valuesSize, err = p.expList()
+			valuesSize, last, err = p.expList()
 			if err != nil {
 				return err
 			}
@@ -287,24 +1139,321 @@ loop:
 		}
 	}
 
-	if valuesSize < byte(len(variables)) {
-		nilsSize := byte(len(variables)) - valuesSize
-		for i := 0; i < int(nilsSize); i++ {
-			stackIndex := byte(len(p.locals)) + valuesSize + byte(i)
-			p.byteCodes = append(p.byteCodes, vm.LoadNil(stackIndex))
+	lastVariable := &variables[len(variables)-1]
+	if int(valuesSize) == len(variables) && lastVariable.attribute == attributeConst && last.isConst() {
+		// the value is inlined, so it does not have to be stored
+		lastVariable.constant = &last
+		valuesSize--
+	}
+
+	base := byte(len(p.locals))
+	switch {
+	case lastVariable.constant != nil && valuesSize == 0:
+	case valuesSize == 0:
+		for i := range byte(len(variables)) {
+			p.byteCodes = append(p.byteCodes, vm.LoadNil(base+i))
 		}
+	case lastVariable.constant != nil:
+		// the values except for the inlined one are already stored by expList
+	default:
+		p.adjustValues(base+valuesSize-1, last, len(variables)-int(valuesSize-1))
 	}
 
 	for _, local := range variables {
-		p.locals = append(p.locals, local)
-		p.localsIndex[local] = byte(len(p.locals) - 1)
+		if err := p.addLocal(local.name); err != nil {
+			return err
+		}
+		p.locals[len(p.locals)-1] = local
+	}
+
+	if closeIndex >= 0 {
+		index := base + byte(closeIndex)
+		p.closeInLoops(index)
+		p.byteCodes = append(p.byteCodes, vm.ToBeClosed(index, p.constants.addString(variables[closeIndex].name)))
+	}
+
+	return nil
+}
+
+// localAttribute parses the optional attribute of a local, which is either <const> or <close>.
+func (p *Parser) localAttribute() (localAttribute, error) {
+	peeked, err := p.lexer.Peek()
+	if err != nil || peeked.Type != lexer.Smaller {
+		return attributeNone, nil
+	}
+	p.lexer.Next()
+
+	name, err := p.lexer.ExpectToken(lexer.Identifier)
+	if err != nil {
+		return attributeNone, err
+	}
+	if _, err := p.lexer.ExpectToken(lexer.Greater); err != nil {
+		return attributeNone, err
+	}
+
+	switch name.Str {
+	case "const":
+		return attributeConst, nil
+	case "close":
+		return attributeClose, nil
+	default:
+		return attributeNone, p.newError(fmt.Errorf("unknown attribute '%v'", name.Str))
+	}
+}
+
+// returnStatement parses the values a function returns. A return has to be the last statement of a block.
+func (p *Parser) returnStatement() error {
+	first := p.stackPointer
+	var returnCount byte
+
+	peeked, err := p.lexer.Peek()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if err == nil && !isBlockEnd(peeked.Type) && peeked.Type != lexer.SemiColon {
+		var last expression
+		returnCount, last, err = p.expList()
+		if err != nil {
+			return err
+		}
+
+		if stackIndex, ok := last.getLocal(); ok && returnCount == 1 {
+			first = stackIndex
+		} else if p.loadAllValues(first+returnCount-1, last) {
+			returnCount = vm.VariableCount
+		}
+	}
+	p.byteCodes = append(p.byteCodes, vm.Return(first, returnCount))
+
+	if err == nil && peeked.Type == lexer.SemiColon {
+		p.lexer.Next()
+	}
+
+	peeked, err = p.lexer.Peek()
+	if err == nil && !isBlockEnd(peeked.Type) {
+		return p.newError(fmt.Errorf("did not expect token '%v' after return", peeked.Type))
+	}
+
+	return nil
+}
+
+// isBlockEnd reports whether the token closes a block.
+func isBlockEnd(tokenType lexer.TokenType) bool {
+	switch tokenType {
+	case lexer.End, lexer.Else, lexer.ElseIf, lexer.Until:
+		return true
+	default:
+		return false
+	}
+}
+
+// functionStatement parses a function definition, which assigns the function to a variable or table field.
+func (p *Parser) functionStatement() error {
+	name, err := p.lexer.ExpectToken(lexer.Identifier)
+	if err != nil {
+		return err
+	}
+
+	stackPointer := p.stackPointer
+	variable := p.variable(name.Str)
+	isMethod := false
+	for !isMethod {
+		peeked, err := p.lexer.Peek()
+		if err != nil {
+			return err
+		}
+		if peeked.Type != lexer.Dot && peeked.Type != lexer.Colon {
+			break
+		}
+		p.lexer.Next()
+		// a method name ends the function name
+		isMethod = peeked.Type == lexer.Colon
+
+		field, err := p.lexer.ExpectToken(lexer.Identifier)
+		if err != nil {
+			return err
+		}
+		tableStackIndex, err := p.loadExpIfNotLocal(stackPointer, variable)
+		if err != nil {
+			return err
+		}
+		variable = newIndexFieldExpression(tableStackIndex, p.constants.addString(field.Str))
+	}
+
+	if err := p.checkAssignable(name, variable); err != nil {
+		return err
+	}
+
+	function, err := p.functionBody(isMethod)
+	if err != nil {
+		return err
+	}
+
+	return p.assignVariable(variable, function)
+}
+
+// localFunction parses a local function definition. The local is declared before the function body, so
+// the function can refer to itself.
+func (p *Parser) localFunction() error {
+	name, err := p.lexer.ExpectToken(lexer.Identifier)
+	if err != nil {
+		return err
+	}
+
+	if err := p.addLocal(name.Str); err != nil {
+		return err
+	}
+	function, err := p.functionBody(false)
+	if err != nil {
+		return err
+	}
+	p.loadExpression(byte(len(p.locals)-1), function)
+
+	return nil
+}
+
+// functionBody parses the parameters and the body of a function into a new prototype and returns an
+// expression which creates a closure of it. Methods get the implicit first parameter self.
+func (p *Parser) functionBody(isMethod bool) (expression, error) {
+	if _, err := p.lexer.ExpectToken(lexer.OpenBracket); err != nil {
+		return expression{}, err
+	}
+
+	p.functionState = newFunctionState(p.functionState)
+	if isMethod {
+		if err := p.addLocal("self"); err != nil {
+			return expression{}, err
+		}
+		p.parameterCount++
+	}
+
+	token, err := p.lexer.Next()
+	if err != nil {
+		return expression{}, err
+	}
+	for token.Type != lexer.ClosedBracket {
+		if token.Type == lexer.TrippleDot {
+			// '...' has to be the last parameter
+			p.isVararg = true
+			if _, err := p.lexer.ExpectToken(lexer.ClosedBracket); err != nil {
+				return expression{}, err
+			}
+			break
+		}
+		if token.Type != lexer.Identifier {
+			return expression{}, p.newError(fmt.Errorf("did not expect token '%v' in parameter list", token.Type))
+		}
+		if err := p.addLocal(token.Str); err != nil {
+			return expression{}, err
+		}
+		p.parameterCount++
+
+		token, err = p.lexer.Next()
+		if err != nil {
+			return expression{}, err
+		}
+		switch token.Type {
+		case lexer.Comma:
+			token, err = p.lexer.Next()
+			if err != nil {
+				return expression{}, err
+			}
+		case lexer.ClosedBracket:
+		default:
+			return expression{}, p.newError(fmt.Errorf("did not expect token '%v' in parameter list", token.Type))
+		}
+	}
+	p.stackPointer = byte(len(p.locals))
+
+	if err := p.scopedBlock(); err != nil {
+		return expression{}, err
+	}
+	if _, err := p.lexer.ExpectToken(lexer.End); err != nil {
+		return expression{}, err
+	}
+	p.byteCodes = append(p.byteCodes, vm.Return(0, 0))
+
+	prototype := p.prototype()
+	p.functionState = p.parent
+	if len(p.prototypes) > math.MaxUint8 {
+		return expression{}, p.newError(fmt.Errorf("too many functions (limit is %v)", math.MaxUint8+1))
+	}
+	p.prototypes = append(p.prototypes, prototype)
+
+	return newFunctionExpression(byte(len(p.prototypes) - 1)), nil
+}
+
+// variable returns the local, upvalue or global variable with the name. Const locals with a literal value
+// are replaced by the value.
+func (p *Parser) variable(name string) expression {
+	if constant, ok := p.constant(name); ok {
+		return constant
+	}
+	if pos, ok := p.findLocal(name); ok {
+		return newLocalExpression(pos)
 	}
+	if index, ok := p.upvalue(name); ok {
+		return newUpvalueExpression(index)
+	}
+
+	return newGlobalExpression(p.constants.addString(name))
+}
+
+// forStateName names the hidden locals of for loops, it can not clash with identifiers.
+const forStateName = "(for state)"
 
+// maxLocals is the number of locals a function can have at the same time, like in the reference
+// implementation.
+const maxLocals = 200
+
+func (p *Parser) addLocal(name string) error {
+	if len(p.locals) >= maxLocals {
+		return p.newError(fmt.Errorf("too many local variables (limit is %v)", maxLocals))
+	}
+	p.locals = append(p.locals, localVariable{name: name})
+	p.growStack(len(p.locals))
 	return nil
 }
 
 func (p *Parser) loadExpTop(expression expression) (byte, error) {
-	return p.loadExpIfNotLocal(p.stackPointer, expression)
+	destination := p.stackPointer
+	if stackIndex, ok := p.reusableStackIndex(expression); ok {
+		destination = stackIndex
+	}
+
+	return p.loadExpIfNotLocal(destination, expression)
+}
+
+// reusableStackIndex returns the lowest temporary stack slot an operation reads from. The operands are
+// consumed by the operation, so its result can take their place instead of growing the stack.
+func (p *Parser) reusableStackIndex(expression expression) (byte, bool) {
+	var operands []byte
+	switch expression.expressionType {
+	case expressionUnaryOperation:
+		operands = []byte{expression.inner.([2]any)[1].(byte)}
+	case expressionBinaryOperation:
+		operation := expression.inner.(binaryOperation)
+		operands = []byte{operation.left}
+		if !operation.rightIsConst {
+			operands = append(operands, operation.right)
+		}
+	case expressionCall:
+		operands = []byte{expression.inner.(functionCall).stackIndex}
+	case expressionConcat:
+		operands = []byte{expression.inner.(concatenation).first}
+	default:
+		return 0, false
+	}
+
+	firstTemporary := byte(len(p.locals))
+	lowest, found := byte(0), false
+	for _, operand := range operands {
+		if operand >= firstTemporary && (!found || operand < lowest) {
+			lowest, found = operand, true
+		}
+	}
+
+	return lowest, found
 }
 
 func (p *Parser) loadExpIfNotLocal(destination byte, expression expression) (byte, error) {
@@ -344,11 +1493,7 @@ func (p *Parser) prefixExp(token lexer.Token) (expression, error) {
 	var exp expression
 	switch token.Type {
 	case lexer.Identifier:
-		if pos, ok := p.localsIndex[token.Str]; ok {
-			exp = newLocalExpression(pos)
-		} else {
-			exp = newGlobalExpression(p.constants.addString(token.Str))
-		}
+		exp = p.variable(token.Str)
 
 	case lexer.OpenBracket:
 		var err error
@@ -359,6 +1504,15 @@ func (p *Parser) prefixExp(token lexer.Token) (expression, error) {
 		if _, err := p.lexer.ExpectToken(lexer.ClosedBracket); err != nil {
 			return expression{}, err
 		}
+		switch exp.expressionType {
+		case expressionCall:
+			// parentheses truncate the results of a call to its first one
+			p.setResultCount(exp, 1)
+			exp = newLocalExpression(exp.inner.(functionCall).stackIndex)
+		case expressionVararg:
+			p.loadExpression(stackPointer, exp)
+			exp = newLocalExpression(stackPointer)
+		}
 
 	default:
 		return expression{}, p.newError(fmt.Errorf("did not expect '%v' in prefixexp", token.Type))
@@ -415,13 +1569,32 @@ func (p *Parser) prefixExp(token lexer.Token) (expression, error) {
 			}
 			exp = newIndexFieldExpression(tableStackIndex, p.constants.addString(identifierToken.Str))
 
+		case lexer.Colon:
+			p.lexer.Next()
+
+			method, err := p.lexer.ExpectToken(lexer.Identifier)
+			if err != nil {
+				return expression{}, err
+			}
+			tableStackIndex, err := p.loadExpIfNotLocal(stackPointer, exp)
+			if err != nil {
+				return expression{}, err
+			}
+			p.byteCodes = append(p.byteCodes, vm.Self(stackPointer, tableStackIndex, p.constants.addString(method.Str)))
+			p.growStack(int(stackPointer) + 2)
+
+			exp, err = p.args(stackPointer, 1)
+			if err != nil {
+				return expression{}, err
+			}
+
 		case lexer.OpenBracket:
 			fallthrough
 		case lexer.OpenBrace:
 			fallthrough
 		case lexer.String:
 			p.loadExpression(stackPointer, exp)
-			exp, err = p.args()
+			exp, err = p.args(stackPointer, 0)
 			if err != nil {
 				return expression{}, err
 			}
@@ -432,9 +1605,10 @@ func (p *Parser) prefixExp(token lexer.Token) (expression, error) {
 	}
 }
 
-func (p *Parser) args() (expression, error) {
-	var argCount byte
-	funcStackIndex := p.stackPointer - 1
+// args parses the arguments of a call of the function at funcStackIndex. The first argCount arguments are
+// already stored behind the function, like the receiver of a method call.
+func (p *Parser) args(funcStackIndex, argCount byte) (expression, error) {
+	p.stackPointer = funcStackIndex + 1 + argCount
 
 	token, err := p.lexer.Next()
 	if err != nil {
@@ -450,52 +1624,114 @@ func (p *Parser) args() (expression, error) {
 		if peeked.Type == lexer.ClosedBracket {
 			p.lexer.Next()
 		} else {
-			argCount, err = p.expList()
+			listSize, last, err := p.expList()
 			if err != nil {
 				return expression{}, err
 			}
+			argCount += listSize
+			if p.loadAllValues(funcStackIndex+argCount, last) {
+				argCount = vm.VariableCount
+			}
 
 			if _, err := p.lexer.ExpectToken(lexer.ClosedBracket); err != nil {
 				return expression{}, err
 			}
 		}
 	case lexer.OpenBrace:
-		p.tableConstructor()
-		argCount = 1
+		if _, err := p.tableConstructor(); err != nil {
+			return expression{}, err
+		}
+		argCount++
 	case lexer.String:
-		p.loadExpression(funcStackIndex+1, newStringExpression(token.Str))
-		argCount = 1
+		p.loadExpression(funcStackIndex+1+argCount, newStringExpression(token.Str))
+		argCount++
 	default:
 		return expression{}, p.newError(fmt.Errorf("invalid args token '%v'", token.Type))
 	}
 
-	p.byteCodes = append(p.byteCodes, vm.Call(funcStackIndex, argCount))
+	p.byteCodes = append(p.byteCodes, vm.Call(funcStackIndex, argCount, 1))
+	p.stackPointer = funcStackIndex + 1
 
-	return newCallExpression(), nil
+	return newCallExpression(functionCall{len(p.byteCodes) - 1, funcStackIndex, argCount}), nil
 }
 
-func (p *Parser) expList() (byte, error) {
+// expList reads a list of expressions and stores them on the stack starting at the stack pointer. The
+// last expression is returned instead of being stored, so the caller can decide how many values it
+// provides. The returned size includes the last expression.
+func (p *Parser) expList() (byte, expression, error) {
 	stackPointer := p.stackPointer
 
 	var size byte
 	for {
 		exp, err := p.readExpression()
 		if err != nil {
-			return 0, err
+			return 0, expression{}, err
 		}
-		p.loadExpression(stackPointer+size, exp)
 		size++
 
 		peeked, err := p.lexer.Peek()
-		if err != nil {
-			return 0, err
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, expression{}, err
 		}
 
-		if peeked.Type != lexer.Comma {
-			return size, nil
+		if err != nil || peeked.Type != lexer.Comma {
+			return size, exp, nil
 		}
 
 		p.lexer.Next()
+		p.loadExpression(stackPointer+size-1, exp)
+	}
+}
+
+// adjustValues stores the last expression of an expression list at destination, so the expression
+// provides count values. A trailing call or '...' provides the values itself, other expressions are padded
+// with nil.
+func (p *Parser) adjustValues(destination byte, last expression, count int) {
+	switch last.expressionType {
+	case expressionCall:
+		p.setResultCount(last, max(count, 0))
+		return
+	case expressionVararg:
+		p.byteCodes = append(p.byteCodes, vm.Vararg(destination, byte(max(count, 0))))
+		p.stackPointer = destination + byte(max(count, 0))
+		p.growStack(int(p.stackPointer))
+		return
+	}
+
+	p.loadExpression(destination, last)
+	for i := 1; i < count; i++ {
+		p.loadExpression(destination+byte(i), newNilExpression())
+	}
+}
+
+// loadAllValues stores the last expression of an expression list at destination and reports whether it
+// is a call or '...' whose values reach up to the top of the stack.
+func (p *Parser) loadAllValues(destination byte, last expression) bool {
+	switch last.expressionType {
+	case expressionCall:
+		p.setResultCount(last, int(vm.VariableCount))
+		return true
+	case expressionVararg:
+		p.byteCodes = append(p.byteCodes, vm.Vararg(destination, vm.VariableCount))
+		p.stackPointer = destination
+		return true
+	}
+
+	p.loadExpression(destination, last)
+	return false
+}
+
+// setResultCount changes the number of results the call expression keeps. The results are stored starting
+// at the stack index of the called function.
+func (p *Parser) setResultCount(callExpression expression, resultCount int) {
+	call := callExpression.inner.(functionCall)
+	p.byteCodes[call.byteCodeIndex] = vm.Call(call.stackIndex, call.argCount, byte(resultCount))
+
+	if byte(resultCount) == vm.VariableCount {
+		p.stackPointer = call.stackIndex
+	} else {
+		p.stackPointer = call.stackIndex + byte(resultCount)
+		p.growStack(int(p.stackPointer))
 	}
 }
 
@@ -530,7 +1766,15 @@ func (p *Parser) loadExpression(destination byte, expression expression) {
 	case expressionGlobal:
 		p.byteCodes = append(p.byteCodes, vm.GetGlobal(destination, expression.inner.(byte)))
 
+	case expressionUpvalue:
+		p.byteCodes = append(p.byteCodes, vm.GetUpvalue(destination, expression.inner.(byte)))
+
 	case expressionCall:
+		p.setResultCount(expression, 1)
+		call := expression.inner.(functionCall)
+		if call.stackIndex != destination {
+			p.byteCodes = append(p.byteCodes, vm.Move(destination, call.stackIndex))
+		}
 
 	case expressionIndex:
 		pair := expression.inner.([2]byte)
@@ -560,22 +1804,76 @@ func (p *Parser) loadExpression(destination byte, expression expression) {
 
 		p.byteCodes = append(p.byteCodes, constructor(destination, sourceStackIndex))
 
+	case expressionBinaryOperation:
+		operation := expression.inner.(binaryOperation)
+
+		p.byteCodes = append(p.byteCodes, operation.byteCode(destination, operation.left, operation.right))
+
+	case expressionFunction:
+		p.byteCodes = append(p.byteCodes, vm.Closure(destination, expression.inner.(byte)))
+
+	case expressionVararg:
+		p.byteCodes = append(p.byteCodes, vm.Vararg(destination, 1))
+
+	case expressionConcat:
+		operands := expression.inner.(concatenation)
+
+		p.byteCodes = append(p.byteCodes, vm.ConcatByteCode(destination, operands.first, operands.count))
+
 	default:
 		panic(fmt.Sprintf("unexpected parser.expressionType: %v", expression.expressionType))
 	}
 
 	p.stackPointer = destination + 1
+	p.growStack(int(p.stackPointer))
 }
 
 func (p *Parser) readExpression() (expression, error) {
+	return p.readSubExpression(0)
+}
+
+func (p *Parser) readSubExpression(limit int) (expression, error) {
 	token, err := p.lexer.Next()
 	if err != nil {
 		return expression{}, fmt.Errorf("reading function parameter: %w", err)
 	}
-	return p.expression(token)
+	return p.subExpression(token, limit)
 }
 
 func (p *Parser) expression(token lexer.Token) (expression, error) {
+	return p.subExpression(token, 0)
+}
+
+// subExpression reads an expression whose binary operators bind tighter than limit.
+func (p *Parser) subExpression(token lexer.Token, limit int) (expression, error) {
+	exp, err := p.simpleExpression(token)
+	if err != nil {
+		return expression{}, err
+	}
+
+	for {
+		peeked, err := p.lexer.Peek()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return exp, nil
+			}
+			return expression{}, err
+		}
+
+		priority, ok := binaryPriorities[peeked.Type]
+		if !ok || priority.left <= limit {
+			return exp, nil
+		}
+		p.lexer.Next()
+
+		exp, err = p.binaryOperation(peeked.Type, exp)
+		if err != nil {
+			return expression{}, fmt.Errorf("reading binary operation '%v': %w", peeked.Type, err)
+		}
+	}
+}
+
+func (p *Parser) simpleExpression(token lexer.Token) (expression, error) {
 	switch token.Type {
 	case lexer.Nil:
 		return newNilExpression(), nil
@@ -589,6 +1887,17 @@ func (p *Parser) expression(token lexer.Token) (expression, error) {
 		return newFloatExpression(token.Float), nil
 	case lexer.String:
 		return newStringExpression(token.Str), nil
+	case lexer.TrippleDot:
+		if !p.isVararg {
+			return expression{}, p.newError(errors.New("cannot use '...' outside a vararg function"))
+		}
+		return newVarargExpression(), nil
+	case lexer.Function:
+		function, err := p.functionBody(false)
+		if err != nil {
+			return expression{}, fmt.Errorf("reading function: %w", err)
+		}
+		return function, nil
 	case lexer.OpenBrace:
 		tableExpr, err := p.tableConstructor()
 		if err != nil {
@@ -635,7 +1944,7 @@ func (p *Parser) expression(token lexer.Token) (expression, error) {
 }
 
 func (p *Parser) negate() (expression, error) {
-	exp, err := p.readExpression()
+	exp, err := p.readSubExpression(unaryPriority)
 	if err != nil {
 		return expression{}, err
 	}
@@ -661,7 +1970,7 @@ func (p *Parser) negate() (expression, error) {
 }
 
 func (p *Parser) not() (expression, error) {
-	exp, err := p.readExpression()
+	exp, err := p.readSubExpression(unaryPriority)
 	if err != nil {
 		return expression{}, err
 	}
@@ -687,7 +1996,7 @@ func (p *Parser) not() (expression, error) {
 }
 
 func (p *Parser) bitNot() (expression, error) {
-	exp, err := p.readExpression()
+	exp, err := p.readSubExpression(unaryPriority)
 	if err != nil {
 		return expression{}, err
 	}
@@ -695,12 +2004,16 @@ func (p *Parser) bitNot() (expression, error) {
 	switch exp.expressionType {
 	case expressionInteger:
 		return newIntegerExpression(^exp.inner.(int64)), nil
+	case expressionFloat:
+		if folded, err := vm.Arithmetic(vm.ArithmeticBitXor, vm.NewFloat(exp.inner.(float64)), vm.NewInteger(-1)); err == nil {
+			integer, _ := folded.Integer()
+			return newIntegerExpression(integer), nil
+		}
+		return expression{}, fmt.Errorf("can not apply bitwise not to '%v' '%v'", exp.expressionType, exp.inner)
 	case expressionNil:
 		fallthrough
 	case expressioinBoolean:
 		fallthrough
-	case expressionFloat:
-		fallthrough
 	case expressionString:
 		return expression{}, fmt.Errorf("can not apply bitwise not to '%v' '%v'", exp.expressionType, exp.inner)
 	default:
@@ -713,7 +2026,7 @@ func (p *Parser) bitNot() (expression, error) {
 }
 
 func (p *Parser) length() (expression, error) {
-	exp, err := p.readExpression()
+	exp, err := p.readSubExpression(unaryPriority)
 	if err != nil {
 		return expression{}, err
 	}
@@ -738,21 +2051,282 @@ func (p *Parser) length() (expression, error) {
 	}
 }
 
+func (p *Parser) binaryOperation(operator lexer.TokenType, left expression) (expression, error) {
+	if operator == lexer.And || operator == lexer.Or {
+		return p.logical(operator, left)
+	}
+
+	if comparison, ok := comparisonOperators[operator]; ok {
+		return p.comparison(comparison, left)
+	}
+
+	if operator == lexer.DoubleDot {
+		return p.concat(left)
+	}
+
+	arithmetic, ok := arithmeticOperators[operator]
+	if !ok {
+		return expression{}, p.newError(fmt.Errorf("unknown binary operator '%v'", operator))
+	}
+
+	if !left.isNumber() {
+		leftStackIndex, err := p.loadExpTop(left)
+		if err != nil {
+			return expression{}, err
+		}
+		left = newLocalExpression(leftStackIndex)
+	}
+
+	right, err := p.readSubExpression(binaryPriorities[operator].right)
+	if err != nil {
+		return expression{}, err
+	}
+
+	if folded, ok := foldArithmetic(arithmetic.operator, left, right); ok {
+		return folded, nil
+	}
+
+	operation := binaryOperation{byteCode: arithmetic.byteCode}
+	switch right.expressionType {
+	case expressionInteger:
+		operation.byteCode, operation.rightIsConst = arithmetic.byteCodeConst, true
+		operation.right = p.constants.addInt(right.inner.(int64))
+	case expressionFloat:
+		operation.byteCode, operation.rightIsConst = arithmetic.byteCodeConst, true
+		operation.right = p.constants.addFloat(right.inner.(float64))
+	default:
+		operation.right, err = p.loadExpTop(right)
+		if err != nil {
+			return expression{}, err
+		}
+	}
+
+	operation.left, err = p.loadExpTop(left)
+	if err != nil {
+		return expression{}, err
+	}
+
+	return newBinaryOperationExpression(operation), nil
+}
+
+// concat compiles '..'. The operands are stored in consecutive stack slots, so a chain of concatenations
+// is compiled into a single Concat byte code. The operator is right associative, so the right operand
+// already is the concatenation of the remaining operands.
+func (p *Parser) concat(left expression) (expression, error) {
+	first, ok := p.reusableStackIndex(left)
+	if !ok {
+		first = p.stackPointer
+	}
+	p.loadExpression(first, left)
+
+	right, err := p.readSubExpression(binaryPriorities[lexer.DoubleDot].right)
+	if err != nil {
+		return expression{}, err
+	}
+
+	if right.expressionType == expressionConcat {
+		if operands := right.inner.(concatenation); operands.first == first+1 {
+			return newConcatExpression(concatenation{first, operands.count + 1}), nil
+		}
+	}
+
+	p.loadExpression(first+1, right)
+	return newConcatExpression(concatenation{first, 2}), nil
+}
+
+// logical compiles 'and' and 'or'. The left operand is stored in a temporary stack slot and tested,
+// if it already decides the result the right operand is jumped over, otherwise it overwrites the slot.
+func (p *Parser) logical(operator lexer.TokenType, left expression) (expression, error) {
+	isAnd := operator == lexer.And
+	if left.isConst() && left.isTruthy() == isAnd {
+		// the result is always the right operand
+		return p.readSubExpression(binaryPriorities[operator].right)
+	}
+
+	var destination byte
+	if stackIndex, ok := left.getLocal(); ok && stackIndex < byte(len(p.locals)) {
+		destination = p.stackPointer
+		p.byteCodes = append(p.byteCodes, vm.TestSet(destination, stackIndex, !isAnd))
+	} else {
+		var err error
+		destination, err = p.loadExpTop(left)
+		if err != nil {
+			return expression{}, err
+		}
+		p.byteCodes = append(p.byteCodes, vm.Test(destination, !isAnd))
+	}
+	p.byteCodes = append(p.byteCodes, vm.Jump(0))
+	jumpIndex := len(p.byteCodes) - 1
+	p.stackPointer = destination + 1
+
+	right, err := p.readSubExpression(binaryPriorities[operator].right)
+	if err != nil {
+		return expression{}, err
+	}
+	p.loadExpression(destination, right)
+
+	if err := p.patchJump(jumpIndex); err != nil {
+		return expression{}, err
+	}
+
+	return newLocalExpression(destination), nil
+}
+
+const noJump = -1
+
+// patchJump lets the jump at jumpIndex continue with the next byte code that will be emitted.
+func (p *Parser) patchJump(jumpIndex int) error {
+	return p.patchJumpTo(jumpIndex, len(p.byteCodes))
+}
+
+func (p *Parser) patchJumpTo(jumpIndex, target int) error {
+	if jumpIndex == noJump {
+		return nil
+	}
+
+	offset, err := p.jumpOffset(jumpIndex, target)
+	if err != nil {
+		return err
+	}
+
+	p.byteCodes[jumpIndex] = vm.Jump(offset)
+	return nil
+}
+
+// jumpOffset returns the offset a jump at jumpIndex needs to continue at target.
+func (p *Parser) jumpOffset(jumpIndex, target int) (int16, error) {
+	offset := target - jumpIndex - 1
+	if offset > math.MaxInt16 || offset < math.MinInt16 {
+		return 0, p.newError(errors.New("jump exceeds maximum byte code offset"))
+	}
+
+	return int16(offset), nil
+}
+
+// jumpTo emits a jump to the byte code at target.
+func (p *Parser) jumpTo(target int) error {
+	p.byteCodes = append(p.byteCodes, vm.Jump(0))
+	return p.patchJumpTo(len(p.byteCodes)-1, target)
+}
+
+func (p *Parser) comparison(comparison comparisonOperator, left expression) (expression, error) {
+	if !left.isConst() {
+		leftStackIndex, err := p.loadExpTop(left)
+		if err != nil {
+			return expression{}, err
+		}
+		left = newLocalExpression(leftStackIndex)
+	}
+
+	right, err := p.readSubExpression(comparisonPriority)
+	if err != nil {
+		return expression{}, err
+	}
+
+	if right.isConst() {
+		leftStackIndex, err := p.loadExpTop(left)
+		if err != nil {
+			return expression{}, err
+		}
+		rightConstIndex, _, err := p.addConstOrLoadExp(right)
+		if err != nil {
+			return expression{}, err
+		}
+
+		return newBinaryOperationExpression(binaryOperation{comparison.byteCodeConst, leftStackIndex, rightConstIndex, true}), nil
+	}
+
+	rightStackIndex, err := p.loadExpTop(right)
+	if err != nil {
+		return expression{}, err
+	}
+
+	if left.isConst() {
+		leftConstIndex, _, err := p.addConstOrLoadExp(left)
+		if err != nil {
+			return expression{}, err
+		}
+
+		return newBinaryOperationExpression(binaryOperation{comparison.byteCodeConstLeft, rightStackIndex, leftConstIndex, true}), nil
+	}
+
+	leftStackIndex := left.inner.(byte)
+	if comparison.swapStackIndexes {
+		leftStackIndex, rightStackIndex = rightStackIndex, leftStackIndex
+	}
+
+	return newBinaryOperationExpression(binaryOperation{comparison.byteCode, leftStackIndex, rightStackIndex, false}), nil
+}
+
+// foldArithmetic evaluates operations on two number literals at compile time. Like lua it does not fold
+// divisions by zero, which may have to raise an error at runtime, and results which are NaN or zero floats.
+func foldArithmetic(operator vm.ArithmeticOperator, left, right expression) (expression, bool) {
+	leftValue, ok := left.numberValue()
+	if !ok {
+		return expression{}, false
+	}
+	rightValue, ok := right.numberValue()
+	if !ok {
+		return expression{}, false
+	}
+
+	switch operator {
+	case vm.ArithmeticDivide, vm.ArithmeticFloorDivide, vm.ArithmeticModulo:
+		if right.isZero() {
+			return expression{}, false
+		}
+	}
+
+	result, err := vm.Arithmetic(operator, leftValue, rightValue)
+	if err != nil {
+		return expression{}, false
+	}
+
+	if integer, ok := result.Integer(); ok {
+		return newIntegerExpression(integer), true
+	}
+
+	float, _ := result.Float()
+	if math.IsNaN(float) || float == 0 {
+		return expression{}, false
+	}
+	return newFloatExpression(float), true
+}
+
 func (p *Parser) tableConstructor() (expression, error) {
 	tableStackIndex := p.stackPointer
 	p.stackPointer++
+	p.growStack(int(p.stackPointer))
 	p.byteCodes = append(p.byteCodes, vm.NewTableByteCode(tableStackIndex, 0, 0))
 	newTableByteCodeIndex := len(p.byteCodes) - 1
 
-	var listCount, tableCount byte
+	// the last list item is kept pending until it is known whether it ends the constructor, in which
+	// case a call adds all its results to the list
+	var (
+		listCount      int
+		tableCount     byte
+		pendingItem    expression
+		hasPendingItem bool
+	)
 loop:
 	for {
-		stackPointer := p.stackPointer
-
 		peeked, err := p.lexer.Peek()
 		if err != nil {
 			return expression{}, err
 		}
+		if peeked.Type == lexer.ClosedBrace {
+			p.lexer.Next()
+			break loop
+		}
+
+		if hasPendingItem {
+			if err := p.storeListItem(tableStackIndex, &listCount, pendingItem); err != nil {
+				return expression{}, p.newError(err)
+			}
+			hasPendingItem = false
+		}
+		// list items are stored behind the table until SetList adds them
+		p.stackPointer = tableStackIndex + 1 + byte(listCount%vm.ListBatchSize)
 
 		var (
 			keyOrValueExpression expression
@@ -760,9 +2334,6 @@ loop:
 		)
 
 		switch peeked.Type {
-		case lexer.ClosedBrace:
-			p.lexer.Next()
-			break loop
 		case lexer.OpenSquareBracket:
 			p.lexer.Next()
 
@@ -792,7 +2363,7 @@ loop:
 				keyOrValueExpression = newStringExpression(keyOrValue.Str)
 				isKey = true
 			} else {
-				keyOrValueExpression, err = p.expression(peeked)
+				keyOrValueExpression, err = p.expression(keyOrValue)
 				if err != nil {
 					return expression{}, fmt.Errorf("reading list item expression: %w", err)
 				}
@@ -820,13 +2391,17 @@ loop:
 				case expressionLocal:
 					return vm.SetTable, vm.SetTableConst, keyOrValueExpression.inner.(byte), nil
 				case expressionInteger:
-					intValue := keyOrValueExpression.inner.(int)
+					intValue := keyOrValueExpression.inner.(int64)
 					if intValue <= math.MaxUint8 && intValue >= 0 {
 						return vm.SetInt, vm.SetIntConst, byte(intValue), nil
 					}
 				}
-				p.loadExpression(p.stackPointer, keyOrValueExpression)
-				return vm.SetTable, vm.SetTableConst, p.stackPointer, nil
+				// the key stays in its stack slot while the value is evaluated
+				keyStackIndex := p.stackPointer
+				p.loadExpression(keyStackIndex, keyOrValueExpression)
+				p.stackPointer++
+				p.growStack(int(p.stackPointer))
+				return vm.SetTable, vm.SetTableConst, keyStackIndex, nil
 			}()
 			if err != nil {
 				return expression{}, err
@@ -848,14 +2423,7 @@ loop:
 			}
 
 		} else {
-			listCount++
-
-			p.loadExpression(stackPointer, keyOrValueExpression)
-
-			if listCount%50 == 0 {
-				p.byteCodes = append(p.byteCodes, vm.SetList(tableStackIndex, 50))
-				p.stackPointer = tableStackIndex + 1
-			}
+			pendingItem, hasPendingItem = keyOrValueExpression, true
 		}
 
 		peeked, err = p.lexer.Peek()
@@ -876,17 +2444,44 @@ loop:
 		}
 	}
 
-	remainingListItems := listCount % 50
-	if remainingListItems > 0 {
-		p.byteCodes = append(p.byteCodes, vm.SetList(tableStackIndex, remainingListItems))
+	batch := byte(listCount / vm.ListBatchSize)
+	switch {
+	case hasPendingItem && pendingItem.isMultiValue():
+		p.loadAllValues(tableStackIndex+1+byte(listCount%vm.ListBatchSize), pendingItem)
+		p.byteCodes = append(p.byteCodes, vm.SetList(tableStackIndex, vm.VariableCount, batch))
+	case hasPendingItem:
+		if err := p.storeListItem(tableStackIndex, &listCount, pendingItem); err != nil {
+			return expression{}, p.newError(err)
+		}
+		fallthrough
+	default:
+		if remainingListItems := listCount % vm.ListBatchSize; remainingListItems > 0 {
+			p.byteCodes = append(p.byteCodes, vm.SetList(tableStackIndex, byte(remainingListItems), batch))
+		}
 	}
 
-	p.byteCodes[newTableByteCodeIndex] = vm.NewTableByteCode(tableStackIndex, listCount, tableCount)
+	p.byteCodes[newTableByteCodeIndex] = vm.NewTableByteCode(tableStackIndex, byte(min(listCount, math.MaxUint8)), tableCount)
+	p.stackPointer = tableStackIndex + 1
 	return newLocalExpression(tableStackIndex), nil
 }
 
+// storeListItem stores a list item of a table constructor behind the items waiting for SetList, which
+// adds them to the table in batches of vm.ListBatchSize.
+func (p *Parser) storeListItem(tableStackIndex byte, listCount *int, item expression) error {
+	if *listCount >= vm.ListBatchSize*(math.MaxUint8+1) {
+		return errors.New("table constructor has too many list items")
+	}
+	p.loadExpression(tableStackIndex+1+byte(*listCount%vm.ListBatchSize), item)
+	*listCount++
+
+	if *listCount%vm.ListBatchSize == 0 {
+		p.byteCodes = append(p.byteCodes, vm.SetList(tableStackIndex, vm.ListBatchSize, byte(*listCount/vm.ListBatchSize-1)))
+	}
+	return nil
+}
+
 func (p *Parser) loadVar(destination byte, identifier string) {
-	if pos, ok := p.localsIndex[identifier]; ok {
+	if pos, ok := p.findLocal(identifier); ok {
 		p.byteCodes = append(p.byteCodes, vm.Move(destination, pos))
 		return
 	}
@@ -905,22 +2500,35 @@ type constantTable struct {
 	falseConstantPos *byte
 	stringConstants  map[string]byte
 	integerConstants map[int64]byte
-	floatConstants   map[float64]byte
+	// floatConstants is keyed by the bits of the floats, so 0.0 and -0.0 get separate constants and NaN
+	// constants are shared.
+	floatConstants map[uint64]byte
+	// overflow is set once more constants have been added than byte codes can refer to.
+	overflow bool
 }
 
 func newConstantTable() *constantTable {
 	return &constantTable{
 		stringConstants:  map[string]byte{},
 		integerConstants: map[int64]byte{},
-		floatConstants:   map[float64]byte{},
+		floatConstants:   map[uint64]byte{},
+	}
+}
+
+// add appends the value to the constants and returns its index.
+func (c *constantTable) add(value vm.Value) byte {
+	if len(c.constants) > math.MaxUint8 {
+		c.overflow = true
+		return 0
 	}
+	c.constants = append(c.constants, value)
+	return byte(len(c.constants) - 1)
 }
 
 func (c *constantTable) addString(value string) byte {
 	pos, ok := c.stringConstants[value]
 	if !ok {
-		c.constants = append(c.constants, vm.NewString(value))
-		pos = byte(len(c.constants) - 1)
+		pos = c.add(vm.NewString(value))
 		c.stringConstants[value] = pos
 	}
 
@@ -931,8 +2539,7 @@ func (c *constantTable) addNil() byte {
 	if c.nilConstantPos != nil {
 		return *c.nilConstantPos
 	}
-	c.constants = append(c.constants, vm.NewNil())
-	pos := byte(len(c.constants) - 1)
+	pos := c.add(vm.NewNil())
 	c.nilConstantPos = &pos
 	return pos
 }
@@ -949,8 +2556,7 @@ func (c *constantTable) addTrue() byte {
 	if c.trueConstantPos != nil {
 		return *c.trueConstantPos
 	}
-	c.constants = append(c.constants, vm.NewBoolean(true))
-	pos := byte(len(c.constants) - 1)
+	pos := c.add(vm.NewBoolean(true))
 	c.trueConstantPos = &pos
 	return pos
 }
@@ -959,8 +2565,7 @@ func (c *constantTable) addFalse() byte {
 	if c.falseConstantPos != nil {
 		return *c.falseConstantPos
 	}
-	c.constants = append(c.constants, vm.NewBoolean(false))
-	pos := byte(len(c.constants) - 1)
+	pos := c.add(vm.NewBoolean(false))
 	c.falseConstantPos = &pos
 	return pos
 }
@@ -968,8 +2573,7 @@ func (c *constantTable) addFalse() byte {
 func (c *constantTable) addInt(value int64) byte {
 	pos, ok := c.integerConstants[value]
 	if !ok {
-		c.constants = append(c.constants, vm.NewInteger(value))
-		pos = byte(len(c.constants) - 1)
+		pos = c.add(vm.NewInteger(value))
 		c.integerConstants[value] = pos
 	}
 
@@ -977,11 +2581,11 @@ func (c *constantTable) addInt(value int64) byte {
 }
 
 func (c *constantTable) addFloat(value float64) byte {
-	pos, ok := c.floatConstants[value]
+	bits := math.Float64bits(value)
+	pos, ok := c.floatConstants[bits]
 	if !ok {
-		c.constants = append(c.constants, vm.NewFloat(value))
-		pos = byte(len(c.constants) - 1)
-		c.floatConstants[value] = pos
+		pos = c.add(vm.NewFloat(value))
+		c.floatConstants[bits] = pos
 	}
 
 	return pos
@@ -1003,13 +2607,111 @@ const (
 	expressionIndexInt
 	expressionCall
 	expressionUnaryOperation
+	expressionBinaryOperation
+	expressionFunction
+	expressionUpvalue
+	expressionVararg
+	expressionConcat
 )
 
+const unaryPriority = 12
+
+type binaryPriority struct {
+	left, right int
+}
+
+var binaryPriorities = map[lexer.TokenType]binaryPriority{
+	lexer.Or:           {1, 1},
+	lexer.And:          {2, 2},
+	lexer.Equal:        {comparisonPriority, comparisonPriority},
+	lexer.NotEqual:     {comparisonPriority, comparisonPriority},
+	lexer.Smaller:      {comparisonPriority, comparisonPriority},
+	lexer.SmallerThan:  {comparisonPriority, comparisonPriority},
+	lexer.Greater:      {comparisonPriority, comparisonPriority},
+	lexer.GreaterThan:  {comparisonPriority, comparisonPriority},
+	lexer.Pipe:         {4, 4},
+	lexer.Tilde:        {5, 5},
+	lexer.Ampersand:    {6, 6},
+	lexer.LeftShift:    {7, 7},
+	lexer.RightShift:   {7, 7},
+	lexer.DoubleDot:    {9, 8}, // right associative
+	lexer.Plus:         {10, 10},
+	lexer.Minus:        {10, 10},
+	lexer.Asterisk:     {11, 11},
+	lexer.Slash:        {11, 11},
+	lexer.EscpaedSlash: {11, 11},
+	lexer.Percentage:   {11, 11},
+	lexer.Cirumflex:    {14, 13}, // right associative
+}
+
+const comparisonPriority = 3
+
+// comparisonOperator describes how a comparison is compiled. There are only byte codes for ==, ~=, < and <=
+// on two stack values, so a > b is compiled as b < a. The const variants compare a stack value with a
+// constant, byteCodeConstLeft is used if the constant is the left operand.
+type comparisonOperator struct {
+	byteCode          func(a, b, c byte) vm.ByteCode
+	swapStackIndexes  bool
+	byteCodeConst     func(a, b, c byte) vm.ByteCode
+	byteCodeConstLeft func(a, b, c byte) vm.ByteCode
+}
+
+var comparisonOperators = map[lexer.TokenType]comparisonOperator{
+	lexer.Equal:       {vm.Equal, false, vm.EqualConst, vm.EqualConst},
+	lexer.NotEqual:    {vm.NotEqual, false, vm.NotEqualConst, vm.NotEqualConst},
+	lexer.Smaller:     {vm.Less, false, vm.LessConst, vm.GreaterConst},
+	lexer.SmallerThan: {vm.LessEqual, false, vm.LessEqualConst, vm.GreaterEqualConst},
+	lexer.Greater:     {vm.Less, true, vm.GreaterConst, vm.LessConst},
+	lexer.GreaterThan: {vm.LessEqual, true, vm.GreaterEqualConst, vm.LessEqualConst},
+}
+
+type arithmeticOperator struct {
+	operator      vm.ArithmeticOperator
+	byteCode      func(a, b, c byte) vm.ByteCode
+	byteCodeConst func(a, b, c byte) vm.ByteCode
+}
+
+var arithmeticOperators = map[lexer.TokenType]arithmeticOperator{
+	lexer.Plus:         {vm.ArithmeticAdd, vm.Add, vm.AddConst},
+	lexer.Minus:        {vm.ArithmeticSubtract, vm.Subtract, vm.SubtractConst},
+	lexer.Asterisk:     {vm.ArithmeticMultiply, vm.Multiply, vm.MultiplyConst},
+	lexer.Slash:        {vm.ArithmeticDivide, vm.Divide, vm.DivideConst},
+	lexer.EscpaedSlash: {vm.ArithmeticFloorDivide, vm.FloorDivide, vm.FloorDivideConst},
+	lexer.Percentage:   {vm.ArithmeticModulo, vm.Modulo, vm.ModuloConst},
+	lexer.Cirumflex:    {vm.ArithmeticPower, vm.Power, vm.PowerConst},
+	lexer.Ampersand:    {vm.ArithmeticBitAnd, vm.BitAnd, vm.BitAndConst},
+	lexer.Pipe:         {vm.ArithmeticBitOr, vm.BitOr, vm.BitOrConst},
+	lexer.Tilde:        {vm.ArithmeticBitXor, vm.BitXor, vm.BitXorConst},
+	lexer.LeftShift:    {vm.ArithmeticShiftLeft, vm.ShiftLeft, vm.ShiftLeftConst},
+	lexer.RightShift:   {vm.ArithmeticShiftRight, vm.ShiftRight, vm.ShiftRightConst},
+}
+
 type expression struct {
 	expressionType expressionType
 	inner          any
 }
 
+// binaryOperation reads its left operand from the stack and its right operand either from the stack
+// or, for the const byte code variants, from the constant table.
+type binaryOperation struct {
+	byteCode     func(a, b, c byte) vm.ByteCode
+	left, right  byte
+	rightIsConst bool
+}
+
+// functionCall describes the Call byte code of a call expression, which is patched once it is known how
+// many results are used.
+type functionCall struct {
+	byteCodeIndex int
+	stackIndex    byte
+	argCount      byte
+}
+
+// concatenation describes the operands of a Concat byte code, which are stored in consecutive stack slots.
+type concatenation struct {
+	first, count byte
+}
+
 func (e expression) getLocal() (byte, bool) {
 	if e.expressionType != expressionLocal {
 		return 0, false
@@ -1018,6 +2720,60 @@ func (e expression) getLocal() (byte, bool) {
 	return e.inner.(byte), true
 }
 
+func (e expression) isNumber() bool {
+	return e.expressionType == expressionInteger || e.expressionType == expressionFloat
+}
+
+// isMultiValue reports whether the expression can provide any number of values, which it does at the end
+// of an expression list.
+func (e expression) isMultiValue() bool {
+	return e.expressionType == expressionCall || e.expressionType == expressionVararg
+}
+
+// isConst reports whether the expression is a literal which can be stored in the constant table.
+func (e expression) isConst() bool {
+	switch e.expressionType {
+	case expressionNil, expressioinBoolean, expressionInteger, expressionFloat, expressionString:
+		return true
+	default:
+		return false
+	}
+}
+
+// isTruthy reports whether a constant expression counts as true in conditions.
+func (e expression) isTruthy() bool {
+	switch e.expressionType {
+	case expressionNil:
+		return false
+	case expressioinBoolean:
+		return e.inner.(bool)
+	default:
+		return true
+	}
+}
+
+func (e expression) isZero() bool {
+	switch e.expressionType {
+	case expressionInteger:
+		return e.inner.(int64) == 0
+	case expressionFloat:
+		return e.inner.(float64) == 0
+	default:
+		return false
+	}
+}
+
+func (e expression) numberValue() (vm.Value, bool) {
+	switch e.expressionType {
+	case expressionInteger:
+		return vm.NewInteger(e.inner.(int64)), true
+	case expressionFloat:
+		return vm.NewFloat(e.inner.(float64)), true
+	default:
+		return vm.Value{}, false
+	}
+}
+
 func newNilExpression() expression {
 	return expression{expressionNil, nil}
 }
@@ -1058,10 +2814,30 @@ func newIndexIntExpression(tableStackIndex, integer byte) expression {
 	return expression{expressionIndexInt, [2]byte{tableStackIndex, integer}}
 }
 
-func newCallExpression() expression {
-	return expression{expressionCall, nil}
+func newCallExpression(call functionCall) expression {
+	return expression{expressionCall, call}
+}
+
+func newUpvalueExpression(upvalueIndex byte) expression {
+	return expression{expressionUpvalue, upvalueIndex}
+}
+
+func newFunctionExpression(prototypeIndex byte) expression {
+	return expression{expressionFunction, prototypeIndex}
+}
+
+func newVarargExpression() expression {
+	return expression{expressionVararg, nil}
+}
+
+func newConcatExpression(operands concatenation) expression {
+	return expression{expressionConcat, operands}
 }
 
 func newUnaryOperationExpression(byteCodeConstructor func(a, b byte) vm.ByteCode, sourceStackIndex byte) expression {
 	return expression{expressionUnaryOperation, [2]any{byteCodeConstructor, sourceStackIndex}}
 }
+
+func newBinaryOperationExpression(operation binaryOperation) expression {
+	return expression{expressionBinaryOperation, operation}
+}
@@ -0,0 +1,251 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type ArithmeticOperator byte
+
+const (
+	ArithmeticAdd ArithmeticOperator = iota
+	ArithmeticSubtract
+	ArithmeticMultiply
+	ArithmeticDivide
+	ArithmeticFloorDivide
+	ArithmeticModulo
+	ArithmeticPower
+	ArithmeticBitAnd
+	ArithmeticBitOr
+	ArithmeticBitXor
+	ArithmeticShiftLeft
+	ArithmeticShiftRight
+)
+
+// arithmeticEvents are the names of the metamethods which define the operators for values which are
+// no numbers.
+var arithmeticEvents = [...]string{
+	ArithmeticAdd:         "__add",
+	ArithmeticSubtract:    "__sub",
+	ArithmeticMultiply:    "__mul",
+	ArithmeticDivide:      "__div",
+	ArithmeticFloorDivide: "__idiv",
+	ArithmeticModulo:      "__mod",
+	ArithmeticPower:       "__pow",
+	ArithmeticBitAnd:      "__band",
+	ArithmeticBitOr:       "__bor",
+	ArithmeticBitXor:      "__bxor",
+	ArithmeticShiftLeft:   "__shl",
+	ArithmeticShiftRight:  "__shr",
+}
+
+// Arithmetic applies operator to a and b. Two integers produce an integer that wraps around on overflow,
+// everything else is computed as float. Division and exponentiation always produce a float, bitwise
+// operations always produce an integer.
+func Arithmetic(operator ArithmeticOperator, a, b Value) (Value, error) {
+	if operator >= ArithmeticBitAnd {
+		return bitwise(operator, a, b)
+	}
+
+	a, ok := toNumber(a)
+	if !ok {
+		return Value{}, fmt.Errorf("Can not perform arithmetic on %v", a.valueType)
+	}
+	b, ok = toNumber(b)
+	if !ok {
+		return Value{}, fmt.Errorf("Can not perform arithmetic on %v", b.valueType)
+	}
+
+	if a.valueType == TypeInteger && b.valueType == TypeInteger && operator != ArithmeticDivide && operator != ArithmeticPower {
+		result, err := integerArithmetic(operator, a.integer(), b.integer())
+		if err != nil {
+			return Value{}, err
+		}
+		return NewInteger(result), nil
+	}
+
+	return NewFloat(floatArithmetic(operator, toFloat(a), toFloat(b))), nil
+}
+
+func integerArithmetic(operator ArithmeticOperator, a, b int64) (int64, error) {
+	switch operator {
+	case ArithmeticAdd:
+		return a + b, nil
+	case ArithmeticSubtract:
+		return a - b, nil
+	case ArithmeticMultiply:
+		return a * b, nil
+	case ArithmeticFloorDivide:
+		if b == 0 {
+			return 0, fmt.Errorf("Can not perform 'n//0'")
+		}
+		if b == -1 {
+			// avoids the overflow of math.MinInt64 / -1
+			return -a, nil
+		}
+		quotient := a / b
+		if a%b != 0 && (a^b) < 0 {
+			quotient--
+		}
+		return quotient, nil
+	case ArithmeticModulo:
+		if b == 0 {
+			return 0, fmt.Errorf("Can not perform 'n%%0'")
+		}
+		if b == -1 {
+			return 0, nil
+		}
+		remainder := a % b
+		if remainder != 0 && (remainder^b) < 0 {
+			remainder += b
+		}
+		return remainder, nil
+	default:
+		panic(fmt.Sprintf("unexpected integer vm.ArithmeticOperator: %#v", operator))
+	}
+}
+
+func floatArithmetic(operator ArithmeticOperator, a, b float64) float64 {
+	switch operator {
+	case ArithmeticAdd:
+		return a + b
+	case ArithmeticSubtract:
+		return a - b
+	case ArithmeticMultiply:
+		return a * b
+	case ArithmeticDivide:
+		return a / b
+	case ArithmeticFloorDivide:
+		return math.Floor(a / b)
+	case ArithmeticModulo:
+		remainder := math.Mod(a, b)
+		if remainder != 0 && (remainder < 0) != (b < 0) {
+			remainder += b
+		}
+		return remainder
+	case ArithmeticPower:
+		if b == 2 {
+			return a * a
+		}
+		return math.Pow(a, b)
+	default:
+		panic(fmt.Sprintf("unexpected float vm.ArithmeticOperator: %#v", operator))
+	}
+}
+
+// bitwise applies the bitwise operator to a and b, which are converted to integers first.
+func bitwise(operator ArithmeticOperator, a, b Value) (Value, error) {
+	x, err := toInteger(a)
+	if err != nil {
+		return Value{}, err
+	}
+	y, err := toInteger(b)
+	if err != nil {
+		return Value{}, err
+	}
+
+	switch operator {
+	case ArithmeticBitAnd:
+		return NewInteger(x & y), nil
+	case ArithmeticBitOr:
+		return NewInteger(x | y), nil
+	case ArithmeticBitXor:
+		return NewInteger(x ^ y), nil
+	case ArithmeticShiftLeft:
+		return NewInteger(shiftLeft(x, y)), nil
+	case ArithmeticShiftRight:
+		// y can not be negated if it is math.MinInt64, but every shift by at least 64 bits is 0 anyway
+		return NewInteger(shiftLeft(x, -max(y, -64))), nil
+	default:
+		panic(fmt.Sprintf("unexpected bitwise vm.ArithmeticOperator: %#v", operator))
+	}
+}
+
+// shiftLeft shifts the bits of a by b to the left, a negative b shifts to the right. Vacant bits are
+// filled with zeros, so shifting by at least 64 bits in either direction results in 0.
+func shiftLeft(a, b int64) int64 {
+	switch {
+	case b <= -64 || b >= 64:
+		return 0
+	case b < 0:
+		return int64(uint64(a) >> -b)
+	default:
+		return int64(uint64(a) << b)
+	}
+}
+
+// toInteger converts the operand of a bitwise operation to an integer. Floats and strings holding a numeral
+// are converted if their value has an exact integer representation.
+func toInteger(value Value) (int64, error) {
+	number, ok := toNumber(value)
+	if !ok {
+		return 0, fmt.Errorf("Can not perform bitwise operation on %v", value.valueType)
+	}
+
+	if number.valueType == TypeInteger {
+		return number.integer(), nil
+	}
+	integer, ok := floatToInteger(number.float())
+	if !ok {
+		return 0, errors.New("number has no integer representation")
+	}
+	return integer, nil
+}
+
+// toNumber returns integers and floats unchanged and converts strings holding a numeral.
+func toNumber(value Value) (Value, bool) {
+	switch value.valueType {
+	case TypeInteger, TypeFloat:
+		return value, true
+	case TypeString:
+		return parseNumber(value.inner.(string))
+	default:
+		return value, false
+	}
+}
+
+func toFloat(number Value) float64 {
+	if number.valueType == TypeInteger {
+		return float64(number.integer())
+	}
+	return number.float()
+}
+
+func parseNumber(str string) (Value, bool) {
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return Value{}, false
+	}
+
+	if integer, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return NewInteger(integer), true
+	}
+
+	unsigned := strings.TrimPrefix(strings.TrimPrefix(str, "-"), "+")
+	if hex, ok := strings.CutPrefix(strings.ToLower(unsigned), "0x"); ok && !strings.ContainsAny(hex, ".p") {
+		// hexadecimal integers wrap around instead of overflowing
+		integer, err := strconv.ParseUint(hex, 16, 64)
+		if err != nil {
+			return Value{}, false
+		}
+		if strings.HasPrefix(str, "-") {
+			return NewInteger(-int64(integer)), true
+		}
+		return NewInteger(int64(integer)), true
+	}
+
+	if strings.ContainsAny(strings.ToLower(unsigned), "ni_") && !strings.HasPrefix(strings.ToLower(unsigned), "0x") {
+		// strconv accepts "inf", "nan" and digit separators which are no numerals in lua
+		return Value{}, false
+	}
+
+	float, err := strconv.ParseFloat(str, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return Value{}, false
+	}
+
+	return NewFloat(float), true
+}
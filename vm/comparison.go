@@ -0,0 +1,134 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+)
+
+// RawEqual compares two values without invoking metamethods. Numbers are equal if they denote the same
+// mathematical value regardless of their subtype, tables and functions are compared by reference.
+func RawEqual(a, b Value) bool {
+	if a.valueType != b.valueType {
+		switch {
+		case a.valueType == TypeInteger && b.valueType == TypeFloat:
+			return equalIntFloat(a.integer(), b.float())
+		case a.valueType == TypeFloat && b.valueType == TypeInteger:
+			return equalIntFloat(b.integer(), a.float())
+		default:
+			return false
+		}
+	}
+
+	switch a.valueType {
+	case TypeNil:
+		return true
+	case TypeFloat:
+		// comparing the bits would make NaN equal to itself and 0.0 unequal to -0.0
+		return a.float() == b.float()
+	default:
+		return a.payload == b.payload && a.inner == b.inner
+	}
+}
+
+func lessThan(a, b Value) (bool, error) {
+	switch {
+	case a.valueType == TypeInteger && b.valueType == TypeInteger:
+		return a.integer() < b.integer(), nil
+	case a.valueType == TypeString && b.valueType == TypeString:
+		return a.inner.(string) < b.inner.(string), nil
+	case isNumber(a) && isNumber(b):
+		return lessNumbers(a, b), nil
+	default:
+		return false, fmt.Errorf("Can not compare %v with %v", a.valueType, b.valueType)
+	}
+}
+
+func lessEqual(a, b Value) (bool, error) {
+	switch {
+	case a.valueType == TypeInteger && b.valueType == TypeInteger:
+		return a.integer() <= b.integer(), nil
+	case a.valueType == TypeString && b.valueType == TypeString:
+		return a.inner.(string) <= b.inner.(string), nil
+	case isNumber(a) && isNumber(b):
+		return lessEqualNumbers(a, b), nil
+	default:
+		return false, fmt.Errorf("Can not compare %v with %v", a.valueType, b.valueType)
+	}
+}
+
+func isNumber(value Value) bool {
+	return value.valueType == TypeInteger || value.valueType == TypeFloat
+}
+
+// lessNumbers compares integers and floats exactly. Converting an integer beyond 2^53 to a float would
+// round it, so these are compared against the float rounded to an integer in the appropriate direction.
+func lessNumbers(a, b Value) bool {
+	switch {
+	case a.valueType == TypeFloat && b.valueType == TypeFloat:
+		return a.float() < b.float()
+	case a.valueType == TypeInteger:
+		integer, float := a.integer(), b.float()
+		if integerFitsFloat(integer) {
+			return float64(integer) < float
+		}
+		if ceil, ok := floatToInteger(math.Ceil(float)); ok {
+			return integer < ceil
+		}
+		return float > 0
+	default:
+		float, integer := a.float(), b.integer()
+		if integerFitsFloat(integer) {
+			return float < float64(integer)
+		}
+		if floor, ok := floatToInteger(math.Floor(float)); ok {
+			return floor < integer
+		}
+		return float < 0
+	}
+}
+
+func lessEqualNumbers(a, b Value) bool {
+	switch {
+	case a.valueType == TypeFloat && b.valueType == TypeFloat:
+		return a.float() <= b.float()
+	case a.valueType == TypeInteger:
+		integer, float := a.integer(), b.float()
+		if integerFitsFloat(integer) {
+			return float64(integer) <= float
+		}
+		if floor, ok := floatToInteger(math.Floor(float)); ok {
+			return integer <= floor
+		}
+		return float > 0
+	default:
+		float, integer := a.float(), b.integer()
+		if integerFitsFloat(integer) {
+			return float <= float64(integer)
+		}
+		if ceil, ok := floatToInteger(math.Ceil(float)); ok {
+			return ceil <= integer
+		}
+		return float < 0
+	}
+}
+
+func equalIntFloat(integer int64, float float64) bool {
+	converted, ok := floatToInteger(float)
+	return ok && converted == integer
+}
+
+// integerFitsFloat reports whether the integer can be converted to a float without rounding.
+func integerFitsFloat(integer int64) bool {
+	const maxExact = 1 << 53
+	return integer >= -maxExact && integer <= maxExact
+}
+
+// floatToInteger converts floats with an exact integer representation. NaN, infinities, floats with
+// a fractional part and floats outside of the int64 range are rejected.
+func floatToInteger(float float64) (int64, bool) {
+	if float != math.Trunc(float) || float < math.MinInt64 || float >= -math.MinInt64 {
+		return 0, false
+	}
+
+	return int64(float), true
+}
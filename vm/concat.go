@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Concat concatenates the values, numbers are converted to strings. The result is built in a single
+// allocation instead of concatenating the values pairwise.
+func Concat(values []Value) (Value, error) {
+	var builder strings.Builder
+	for _, value := range values {
+		switch value.valueType {
+		case TypeString:
+			builder.Grow(len(value.inner.(string)))
+		case TypeInteger, TypeFloat:
+			builder.Grow(24)
+		default:
+			return Value{}, fmt.Errorf("attempt to concatenate a %v value", value.valueType)
+		}
+	}
+
+	for _, value := range values {
+		switch value.valueType {
+		case TypeString:
+			builder.WriteString(value.inner.(string))
+		case TypeInteger:
+			builder.WriteString(strconv.FormatInt(value.integer(), 10))
+		case TypeFloat:
+			builder.WriteString(formatFloat(value.float()))
+		}
+	}
+
+	return NewString(builder.String()), nil
+}
+
+// concat concatenates the values from right to left like the operator does. Pairs which can not be
+// concatenated are passed to the __concat metamethod of either value.
+func (v *VM) concat(values []Value) (Value, error) {
+	values = slices.Clone(values)
+
+	result := values[len(values)-1]
+	for i := len(values) - 2; i >= 0; i-- {
+		concatenated, err := Concat([]Value{values[i], result})
+		if err != nil {
+			if concatenated, err = v.binaryMetamethod("__concat", values[i], result, err); err != nil {
+				return Value{}, err
+			}
+		}
+		result = concatenated
+	}
+
+	return result, nil
+}
+
+// formatFloat formats the float like Lua does with 14 significant digits. Floats with an integer value
+// keep a trailing .0, so they can be told apart from integers.
+func formatFloat(float float64) string {
+	switch {
+	case math.IsInf(float, 1):
+		return "inf"
+	case math.IsInf(float, -1):
+		return "-inf"
+	case math.IsNaN(float):
+		return "nan"
+	}
+
+	formatted := strconv.FormatFloat(float, 'g', 14, 64)
+	if !strings.ContainsAny(formatted, ".e") {
+		formatted += ".0"
+	}
+
+	return formatted
+}
@@ -0,0 +1,370 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Prototype is a compiled Lua function. Every function has its own constants and byte codes, the
+// functions defined inside of it are stored as prototypes as well and instantiated by the Closure byte code.
+type Prototype struct {
+	Constants      []Value
+	ByteCodes      []ByteCode
+	Prototypes     []*Prototype
+	ParameterCount byte
+	// IsVararg is set for functions whose extra arguments are accessible as '...'.
+	IsVararg bool
+	Upvalues []UpvalueDescriptor
+	// MaxStackSize is the number of stack slots the function uses at most.
+	MaxStackSize int
+}
+
+// UpvalueDescriptor tells a new closure where to find an upvalue. InStack upvalues capture the local at
+// Index of the enclosing function, otherwise the upvalue at Index of the enclosing function is shared.
+type UpvalueDescriptor struct {
+	InStack bool
+	Index   byte
+}
+
+// closure is a Lua function value, an instance of a prototype.
+type closure struct {
+	prototype *Prototype
+	upvalues  []*upvalue
+}
+
+// upvalue is a local of an enclosing function captured by a closure. As long as the local is in scope,
+// the upvalue is open and refers to its stack slot. Once the local goes out of scope the upvalue is
+// closed and holds the value itself.
+type upvalue struct {
+	stackIndex int
+	open       bool
+	value      Value
+}
+
+func (u *upvalue) get(stack []Value) Value {
+	if u.open {
+		return stack[u.stackIndex]
+	}
+	return u.value
+}
+
+func (u *upvalue) set(stack []Value, value Value) {
+	if u.open {
+		stack[u.stackIndex] = value
+	} else {
+		u.value = value
+	}
+}
+
+// callFrame holds the state of a running Lua function.
+type callFrame struct {
+	closure *closure
+	// funcIndex is the stack index of the called function, the results are stored there.
+	funcIndex int
+	// base is the stack index of the function's first register.
+	base int
+	// varargCount is the number of extra arguments of a vararg function, they are stored right below base.
+	varargCount int
+	// pc is the index of the next byte code. While the function calls another Lua function it is the
+	// address execution returns to.
+	pc int
+	// resultCount is the number of results the caller expects.
+	resultCount int
+}
+
+// multipleResults is the result count of calls keeping all results, which sets the top of the stack
+// behind the last result.
+const multipleResults = -1
+
+// maxCallDepth limits the number of nested Lua calls so endless recursion fails instead of exhausting
+// the memory.
+const maxCallDepth = 200000
+
+// run executes byte codes until the function of the topmost call frame returns.
+func (v *VM) run() error {
+	depth := len(v.frames)
+	for len(v.frames) >= depth {
+		if v.finalizersPending.Load() && !v.finalizing {
+			// between two byte codes finalizers can run like any other call
+			v.runFinalizers()
+		}
+
+		frame := &v.frames[len(v.frames)-1]
+		byteCodeIndex := frame.pc
+		byteCode := frame.closure.prototype.ByteCodes[byteCodeIndex]
+		frame.pc++
+
+		if err := v.step(frame, byteCode); err != nil {
+			return v.unwind(depth, fmt.Errorf("executing %+v: %w", byteCode, err))
+		}
+
+		if !v.debug {
+			continue
+		}
+
+		var stringBuilder strings.Builder
+		stringBuilder.WriteString("Stack: ")
+		for stackIndex, value := range v.stack {
+			fmt.Fprintf(&stringBuilder, "%v=[%v] ", stackIndex, value)
+		}
+
+		v.logger.Debug(fmt.Sprintf("Step %v. %+v %v", byteCodeIndex, byteCode, stringBuilder.String()))
+	}
+
+	return nil
+}
+
+// unwind pops the call frames from depth on after err occurred. The upvalues of their locals are closed
+// and their close locals are closed with the error, an error while closing replaces err.
+func (v *VM) unwind(depth int, err error) error {
+	for len(v.frames) >= depth {
+		frame := v.frames[len(v.frames)-1]
+
+		v.closeUpvalues(frame.base)
+		if closeErr := v.closeVariables(frame.base, NewString(err.Error()), frame.base+frame.closure.prototype.MaxStackSize); closeErr != nil {
+			err = closeErr
+		}
+
+		v.frames = v.frames[:len(v.frames)-1]
+	}
+
+	return err
+}
+
+// call calls the function at funcIndex with the argCount values following it as arguments. The results
+// are stored starting at funcIndex, they are truncated or padded with nil to resultCount values unless
+// resultCount is multipleResults.
+func (v *VM) call(funcIndex, argCount, resultCount int) error {
+	pushedFrame, err := v.prepareCall(funcIndex, argCount, resultCount)
+	if err != nil || !pushedFrame {
+		return err
+	}
+
+	return v.run()
+}
+
+// prepareCall calls Go functions right away. Lua functions get a new call frame instead, which is executed
+// by the byte code loop. It reports whether a frame was pushed.
+func (v *VM) prepareCall(funcIndex, argCount, resultCount int) (bool, error) {
+	stackItem := v.stack[funcIndex]
+	for range maxMetaChain {
+		if stackItem.valueType == TypeFunction {
+			break
+		}
+
+		// other values are called by their __call metamethod, which gets the value as first argument
+		metamethod := v.metamethod(stackItem, "__call")
+		if metamethod.valueType == TypeNil {
+			return false, fmt.Errorf("expected %v. stack item to be a function but it is of type %v", funcIndex, stackItem.valueType)
+		}
+
+		v.growStack(funcIndex + argCount + 2)
+		copy(v.stack[funcIndex+1:], v.stack[funcIndex:funcIndex+argCount+1])
+		v.stack[funcIndex] = metamethod
+		argCount++
+		stackItem = metamethod
+	}
+	if stackItem.valueType != TypeFunction {
+		return false, errors.New("'__call' chain too long; possible loop")
+	}
+
+	switch function := stackItem.inner.(type) {
+	case *closure:
+		return true, v.pushFrame(function, funcIndex, argCount, resultCount)
+	case *vmFunc:
+		return false, v.callGo(*function, funcIndex, argCount, resultCount)
+	default:
+		panic(fmt.Sprintf("unexpected function type %T", function))
+	}
+}
+
+func (v *VM) pushFrame(function *closure, funcIndex, argCount, resultCount int) error {
+	if len(v.frames) >= maxCallDepth {
+		return errors.New("stack overflow")
+	}
+
+	prototype := function.prototype
+	parameterCount := int(prototype.ParameterCount)
+	frame := callFrame{closure: function, funcIndex: funcIndex, base: funcIndex + 1, resultCount: resultCount}
+
+	if !prototype.IsVararg {
+		v.growStack(frame.base + prototype.MaxStackSize)
+
+		// missing arguments are nil
+		for i := argCount; i < parameterCount; i++ {
+			v.stack[frame.base+i] = NewNil()
+		}
+
+		v.frames = append(v.frames, frame)
+		return nil
+	}
+
+	// the fixed parameters are copied behind the arguments, so the extra arguments end right below base
+	frame.varargCount = max(argCount-parameterCount, 0)
+	frame.base += max(argCount, parameterCount)
+	v.growStack(frame.base + prototype.MaxStackSize)
+
+	for i := range parameterCount {
+		if i < argCount {
+			v.stack[frame.base+i] = v.stack[funcIndex+1+i]
+		} else {
+			v.stack[frame.base+i] = NewNil()
+		}
+	}
+
+	v.frames = append(v.frames, frame)
+	return nil
+}
+
+// varargs copies the extra arguments of the vararg function running in frame to destination, truncated or
+// padded with nil to count values. If count is multipleResults, all of them are copied and the top is set
+// behind them.
+func (v *VM) varargs(frame *callFrame, destination, count int) {
+	if count == multipleResults {
+		count = frame.varargCount
+		v.top = destination + count
+	}
+	v.growStack(destination + count)
+
+	first := frame.base - frame.varargCount
+	for i := range count {
+		if i < frame.varargCount {
+			v.stack[destination+i] = v.stack[first+i]
+		} else {
+			v.stack[destination+i] = NewNil()
+		}
+	}
+}
+
+// newClosure instantiates the prototype inside of the function running in frame.
+func (v *VM) newClosure(frame *callFrame, prototype *Prototype) *closure {
+	upvalues := make([]*upvalue, len(prototype.Upvalues))
+	for i, descriptor := range prototype.Upvalues {
+		if descriptor.InStack {
+			upvalues[i] = v.findUpvalue(frame.base + int(descriptor.Index))
+		} else {
+			upvalues[i] = frame.closure.upvalues[descriptor.Index]
+		}
+	}
+
+	return &closure{prototype, upvalues}
+}
+
+// findUpvalue returns the open upvalue of the stack slot, so all closures capturing a local share it.
+func (v *VM) findUpvalue(stackIndex int) *upvalue {
+	// open upvalues are sorted by their stack index
+	i := len(v.openUpvalues)
+	for ; i > 0 && v.openUpvalues[i-1].stackIndex >= stackIndex; i-- {
+		if v.openUpvalues[i-1].stackIndex == stackIndex {
+			return v.openUpvalues[i-1]
+		}
+	}
+
+	upvalue := &upvalue{stackIndex: stackIndex, open: true}
+	v.openUpvalues = slices.Insert(v.openUpvalues, i, upvalue)
+	return upvalue
+}
+
+// closeUpvalues closes the open upvalues of all stack slots from level on.
+func (v *VM) closeUpvalues(level int) {
+	for len(v.openUpvalues) > 0 {
+		last := v.openUpvalues[len(v.openUpvalues)-1]
+		if last.stackIndex < level {
+			return
+		}
+
+		last.value = v.stack[last.stackIndex]
+		last.open = false
+		v.openUpvalues = v.openUpvalues[:len(v.openUpvalues)-1]
+	}
+}
+
+// markToBeClosed registers the close local name at stackIndex. Its value is closed by calling its __close
+// metamethod once the local goes out of scope, nil and false are not closed.
+func (v *VM) markToBeClosed(stackIndex int, name string) error {
+	value := v.stack[stackIndex]
+	if !value.IsTruthy() {
+		return nil
+	}
+	if v.metamethod(value, "__close").valueType == TypeNil {
+		return fmt.Errorf("variable '%v' got a non-closable value", name)
+	}
+
+	v.toBeClosed = append(v.toBeClosed, stackIndex)
+	return nil
+}
+
+// closeVariables closes the close locals from level on in the reverse order of their declaration. The
+// __close metamethods get the error which leaves the scope or nil as second argument, they are called at
+// top so they do not overwrite any values in use.
+func (v *VM) closeVariables(level int, errorValue Value, top int) error {
+	for len(v.toBeClosed) > 0 {
+		last := v.toBeClosed[len(v.toBeClosed)-1]
+		if last < level {
+			return nil
+		}
+		v.toBeClosed = v.toBeClosed[:len(v.toBeClosed)-1]
+
+		value := v.stack[last]
+		v.setStack(top, v.metamethod(value, "__close"))
+		v.setStack(top+1, value)
+		v.setStack(top+2, errorValue)
+		if err := v.call(top, 2, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// returnResults pops the topmost call frame and stores count values starting at first where the caller
+// expects the results.
+func (v *VM) returnResults(first, count int) {
+	frame := v.frames[len(v.frames)-1]
+	v.frames = v.frames[:len(v.frames)-1]
+
+	v.closeUpvalues(frame.base)
+
+	v.storeResults(frame.funcIndex, first, count, frame.resultCount)
+}
+
+func (v *VM) callGo(function vmFunc, funcIndex, argCount, resultCount int) error {
+	callerFuncIndex, callerTop := v.funcIndex, v.top
+	v.funcIndex, v.top = funcIndex, funcIndex+1+argCount
+
+	returnCount, err := function(v)
+	first := v.top - returnCount
+
+	v.funcIndex, v.top = callerFuncIndex, callerTop
+	if err != nil {
+		return err
+	}
+
+	v.storeResults(funcIndex, first, returnCount, resultCount)
+	return nil
+}
+
+// storeResults moves count results from first to destination, truncated or padded with nil to resultCount
+// values. If resultCount is multipleResults, all results are kept and the top is set behind them.
+func (v *VM) storeResults(destination, first, count, resultCount int) {
+	if resultCount == multipleResults {
+		resultCount = count
+		v.top = destination + count
+	}
+
+	for i := range resultCount {
+		if i < count {
+			v.setStack(destination+i, v.stack[first+i])
+		} else {
+			v.setStack(destination+i, NewNil())
+		}
+	}
+}
+
+func (v *VM) growStack(size int) {
+	if size > len(v.stack) {
+		v.stack = append(v.stack, make([]Value, size-len(v.stack))...)
+	}
+}
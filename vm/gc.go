@@ -0,0 +1,288 @@
+package vm
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"weak"
+)
+
+// Userdata is a Go value which is passed through Lua code. Like tables it can have a metatable.
+type Userdata struct {
+	Data      any
+	metatable *Table
+	// address is the address of the collected userdata a finalizer is called with a copy of.
+	address string
+}
+
+func (u *Userdata) String() string {
+	if u.metatable != nil {
+		if name := u.metatable.Get(NewString("__name")); name.valueType == TypeString {
+			if u.address != "" {
+				return fmt.Sprintf("%v: %v", name.inner, u.address)
+			}
+			return fmt.Sprintf("%v: %p", name.inner, u)
+		}
+	}
+	return "userdata"
+}
+
+// NewUserdata returns a userdata holding data. If metatable is a table it becomes the metatable of the
+// userdata, its __gc metamethod is called with a userdata holding the same data once the userdata has been
+// collected.
+func (v *VM) NewUserdata(data any, metatable Value) Value {
+	userdata := &Userdata{Data: data}
+	value := Value{valueType: TypeUserdata, inner: userdata}
+	if metatable.valueType != TypeTable {
+		return value
+	}
+
+	userdata.metatable = metatable.inner.(*Table)
+	if userdata.metatable.Get(NewString("__gc")).valueType != TypeNil {
+		v.setFinalizer(value)
+	}
+	return value
+}
+
+// weaken returns a weak reference to collectable values, which are tables, functions and userdata. Other
+// values are returned unchanged. Weak references to the same value are equal, so they can be used as keys.
+func weaken(value Value) Value {
+	switch inner := value.inner.(type) {
+	case *Table:
+		return Value{valueType: value.valueType, inner: weak.Make(inner)}
+	case *closure:
+		return Value{valueType: value.valueType, inner: weak.Make(inner)}
+	case *vmFunc:
+		return Value{valueType: value.valueType, inner: weak.Make(inner)}
+	case *Userdata:
+		return Value{valueType: value.valueType, inner: weak.Make(inner)}
+	default:
+		return value
+	}
+}
+
+// strengthen returns the value a weak reference refers to or nil if it has been collected. Other values
+// are returned unchanged.
+func strengthen(value Value) Value {
+	switch inner := value.inner.(type) {
+	case weak.Pointer[Table]:
+		return strongValue(value.valueType, inner)
+	case weak.Pointer[closure]:
+		return strongValue(value.valueType, inner)
+	case weak.Pointer[vmFunc]:
+		return strongValue(value.valueType, inner)
+	case weak.Pointer[Userdata]:
+		return strongValue(value.valueType, inner)
+	default:
+		return value
+	}
+}
+
+func strongValue[T any](valueType Type, pointer weak.Pointer[T]) Value {
+	strong := pointer.Value()
+	if strong == nil {
+		return NewNil()
+	}
+	return Value{valueType: valueType, inner: strong}
+}
+
+// collected reports whether the value is a weak reference whose value has been collected.
+func collected(value Value) bool {
+	return value.valueType != TypeNil && strengthen(value).valueType == TypeNil
+}
+
+// setMode makes the keys and values of the table weak as the __mode field of the metatable demands, the
+// existing entries are converted.
+func (t *Table) setMode(metatable *Table) {
+	var mode string
+	if metatable != nil {
+		if modeField := metatable.Get(NewString("__mode")); modeField.valueType == TypeString {
+			mode = modeField.inner.(string)
+		}
+	}
+
+	t = t.storage()
+	weakKeys, weakValues := strings.Contains(mode, "k"), strings.Contains(mode, "v")
+	if weakKeys == t.weakKeys && weakValues == t.weakValues {
+		return
+	}
+	t.sweep()
+
+	entries := t.entries
+	t.hashIndex, t.entries = make(map[Value]int, len(entries)), make([]tableEntry, 0, len(entries))
+	for _, entry := range entries {
+		key, value := strengthen(entry.key), strengthen(entry.value)
+		if key.valueType == TypeNil || value.valueType == TypeNil {
+			continue
+		}
+		if weakKeys {
+			key = weaken(key)
+		}
+		if weakValues {
+			value = weaken(value)
+		}
+		t.appendEntry(key, value)
+	}
+	for i, value := range t.array {
+		value = strengthen(value)
+		if weakValues {
+			value = weaken(value)
+		}
+		t.array[i] = value
+	}
+
+	t.weakKeys, t.weakValues = weakKeys, weakValues
+}
+
+// sweep removes the entries of a weak table whose key or value has been collected.
+func (t *Table) sweep() {
+	if !t.weakKeys && !t.weakValues {
+		return
+	}
+
+	for i, entry := range t.entries {
+		if collected(entry.key) || collected(entry.value) {
+			t.entries[i].value = NewNil()
+		}
+	}
+}
+
+// finalizable is an object with a __gc metamethod which has not been finalized yet.
+type finalizable struct {
+	// object is a weak reference to the object.
+	object Value
+	// finalization is passed to the finalizer once the object has been collected. It shares the fields or
+	// the data of the object but the object does not refer to it, so it does not keep the object alive.
+	finalization Value
+	cleanup      runtime.Cleanup
+}
+
+// setFinalizer arranges for the __gc metamethod of the object to be called once the object has been
+// collected. Go can not pass the collected object to the finalizer, it is called with the contents of a
+// table or a userdata holding the same data instead. They are printed with the address of the object.
+// Tables store references to themselves as self references, so tables referring to themselves are
+// collected. Other objects referring back to the object, except for the table being its own metatable,
+// keep it alive until the script ends.
+func (v *VM) setFinalizer(object Value) {
+	var entry finalizable
+	switch inner := object.inner.(type) {
+	case *Table:
+		if inner.contents != nil {
+			return
+		}
+		contents := *inner
+		*inner = Table{metatable: inner.metatable, contents: &contents}
+		contents.metatable = inner.contentsMetatable()
+		entry.finalization = NewTable(&contents)
+		entry.cleanup = runtime.AddCleanup(inner, signalFinalizers, v.finalizersPending)
+	case *Userdata:
+		copied := &Userdata{Data: inner.Data, metatable: inner.metatable, address: fmt.Sprintf("%p", inner)}
+		entry.finalization = Value{valueType: TypeUserdata, inner: copied}
+		entry.cleanup = runtime.AddCleanup(inner, signalFinalizers, v.finalizersPending)
+	default:
+		return
+	}
+
+	entry.object = weaken(object)
+	v.finalizable = append(v.finalizable, entry)
+}
+
+// signalFinalizers is the cleanup of the objects with a __gc metamethod. Go runs cleanups on its own
+// goroutine, so it only signals the interpreter to call the finalizers between two byte codes, which keeps
+// scripts from observing concurrent changes.
+func signalFinalizers(pending *atomic.Bool) {
+	pending.Store(true)
+}
+
+// runFinalizers calls the __gc metamethods of the objects which have been collected in the order of their
+// registration. Errors in finalizers are logged and do not stop the script.
+func (v *VM) runFinalizers() {
+	v.finalizing = true
+	defer func() { v.finalizing = false }()
+	v.finalizersPending.Store(false)
+
+	var finalizations []Value
+	v.finalizable = slices.DeleteFunc(v.finalizable, func(object finalizable) bool {
+		if !collected(object.object) {
+			return false
+		}
+		finalizations = append(finalizations, object.finalization)
+		return true
+	})
+
+	for _, finalization := range finalizations {
+		v.finalize(finalization)
+	}
+}
+
+func (v *VM) finalize(object Value) {
+	metamethod := v.metamethod(object, "__gc")
+	if metamethod.valueType == TypeNil {
+		return
+	}
+
+	if _, err := v.callMetamethod(metamethod, object); err != nil {
+		v.logger.Warn("error in __gc metamethod", "error", err)
+	}
+}
+
+// collect runs a full garbage collection and calls the finalizers of the collected objects. The weak
+// references to the collected objects have been cleared once runtime.GC returns, so the finalizers are
+// called right away without waiting for the cleanups.
+func (v *VM) collect() {
+	// unused stack slots may still refer to objects which would be kept alive
+	clear(v.stack[v.top:])
+	runtime.GC()
+
+	if !v.finalizing {
+		v.runFinalizers()
+	}
+}
+
+// finalizeAll calls the finalizers of all objects with a __gc metamethod in the reverse order of their
+// registration, including the objects which have not been collected, like closing a Lua state does.
+func (v *VM) finalizeAll() {
+	v.runFinalizers()
+
+	finalizable := v.finalizable
+	v.finalizable = nil
+	for _, object := range slices.Backward(finalizable) {
+		object.cleanup.Stop()
+		if strong := strengthen(object.object); strong.valueType != TypeNil {
+			v.finalize(strong)
+		} else {
+			v.finalize(object.finalization)
+		}
+	}
+
+	v.runFinalizers()
+}
+
+// CollectGarbage controls the garbage collector. The option "collect", which is the default, runs a full
+// collection and calls the finalizers of the collected objects, "count" returns the memory in use in
+// kilobytes.
+func CollectGarbage(vm *VM) (int, error) {
+	option := "collect"
+	if vm.Arg(0).valueType != TypeNil {
+		var err error
+		if option, err = stringArg(vm, 0, "collectgarbage"); err != nil {
+			return 0, err
+		}
+	}
+
+	switch option {
+	case "collect":
+		vm.collect()
+		vm.Push(NewInteger(0))
+	case "count":
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		vm.Push(NewFloat(float64(stats.HeapAlloc) / 1024))
+	default:
+		return 0, fmt.Errorf("bad argument #1 to 'collectgarbage' (invalid option '%v')", option)
+	}
+
+	return 1, nil
+}
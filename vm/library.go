@@ -0,0 +1,347 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Select returns the arguments following its first argument n. A negative n counts from the last
+// argument, select('#', ...) returns the number of the remaining arguments instead.
+func Select(vm *VM) (int, error) {
+	count := int64(vm.ArgCount() - 1)
+
+	if first := vm.Arg(0); first.valueType == TypeString && first.inner.(string) == "#" {
+		vm.Push(NewInteger(count))
+		return 1, nil
+	}
+
+	n, err := integerArg(vm, 0, "select")
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		n += count + 1
+	}
+	if n < 1 {
+		return 0, errors.New("bad argument #1 to 'select' (index out of range)")
+	}
+
+	for i := n; i <= count; i++ {
+		vm.Push(vm.Arg(int(i)))
+	}
+
+	return int(max(count-n+1, 0)), nil
+}
+
+// Next returns the field of its first argument, which has to be a table, following the key given as second
+// argument. For a nil key the first field is returned, after the last field nil is returned. The array part
+// is traversed in order, followed by the other fields in the order they were added.
+func Next(vm *VM) (int, error) {
+	tableArg := vm.Arg(0)
+	if tableArg.valueType != TypeTable {
+		return 0, fmt.Errorf("bad argument #1 to 'next' (table expected, got %v)", tableArg.valueType)
+	}
+
+	key, value, ok := tableArg.inner.(*Table).Next(vm.Arg(1))
+	if !ok {
+		return 0, errors.New("invalid key to 'next'")
+	}
+	if key.valueType == TypeNil {
+		vm.Push(key)
+		return 1, nil
+	}
+
+	vm.Push(key)
+	vm.Push(value)
+	return 2, nil
+}
+
+var nextFunction = NewFuntion(Next)
+
+// Pairs returns the next function, its argument and nil, so a generic for loop traverses all fields of the
+// table. If the argument has a __pairs metamethod, the first three results of calling it with the argument
+// are returned instead.
+func Pairs(vm *VM) (int, error) {
+	arg := vm.Arg(0)
+	if metamethod := vm.metamethod(arg, "__pairs"); metamethod.valueType != TypeNil {
+		first, err := vm.callBehindTop(metamethod, 3, arg)
+		if err != nil {
+			return 0, err
+		}
+
+		results := [3]Value(vm.stack[first : first+3])
+		for _, result := range results {
+			vm.Push(result)
+		}
+		return 3, nil
+	}
+
+	if arg.valueType != TypeTable {
+		return 0, fmt.Errorf("bad argument #1 to 'pairs' (table expected, got %v)", arg.valueType)
+	}
+
+	vm.Push(nextFunction)
+	vm.Push(arg)
+	vm.Push(NewNil())
+	return 3, nil
+}
+
+// IPairs returns an iterator function, its argument and 0, so a generic for loop traverses the fields 1, 2,
+// ... of the argument up to the first nil value. The fields are read like by an index expression, so the
+// __index metamethod is used.
+func IPairs(vm *VM) (int, error) {
+	if vm.ArgCount() == 0 {
+		return 0, errors.New("bad argument #1 to 'ipairs' (table expected, got no value)")
+	}
+
+	vm.Push(ipairsIteratorFunction)
+	vm.Push(vm.Arg(0))
+	vm.Push(NewInteger(0))
+	return 3, nil
+}
+
+func ipairsIterator(vm *VM) (int, error) {
+	index, err := integerArg(vm, 1, "ipairs iterator")
+	if err != nil {
+		return 0, err
+	}
+	index++
+
+	value, err := vm.index(vm.Arg(0), NewInteger(index))
+	if err != nil {
+		return 0, err
+	}
+	if value.valueType == TypeNil {
+		vm.Push(value)
+		return 1, nil
+	}
+
+	vm.Push(NewInteger(index))
+	vm.Push(value)
+	return 2, nil
+}
+
+var ipairsIteratorFunction = NewFuntion(ipairsIterator)
+
+// TablePack returns a new table holding its arguments as list items and their number as field n.
+func TablePack(vm *VM) (int, error) {
+	table := &Table{array: make([]Value, 0, vm.ArgCount())}
+	for i := range vm.ArgCount() {
+		table.Add(vm.Arg(i))
+	}
+	table.Put(NewString("n"), NewInteger(int64(vm.ArgCount())))
+
+	vm.Push(NewTable(table))
+	return 1, nil
+}
+
+// maxUnpackCount limits the number of values table.unpack returns, so a huge range fails instead of
+// exhausting the memory.
+const maxUnpackCount = 1 << 20
+
+// TableUnpack returns the list items of the table from index i, which defaults to 1, to index j, which
+// defaults to the length of the table.
+func TableUnpack(vm *VM) (int, error) {
+	tableArg := vm.Arg(0)
+	if tableArg.valueType != TypeTable {
+		return 0, fmt.Errorf("bad argument #1 to 'unpack' (table expected, got %v)", tableArg.valueType)
+	}
+	table := tableArg.inner.(*Table)
+
+	first := int64(1)
+	if vm.Arg(1).valueType != TypeNil {
+		var err error
+		if first, err = integerArg(vm, 1, "unpack"); err != nil {
+			return 0, err
+		}
+	}
+	last := int64(table.Length())
+	if vm.Arg(2).valueType != TypeNil {
+		var err error
+		if last, err = integerArg(vm, 2, "unpack"); err != nil {
+			return 0, err
+		}
+	}
+
+	if first > last {
+		return 0, nil
+	}
+	if uint64(last-first) >= maxUnpackCount {
+		return 0, errors.New("too many results to unpack")
+	}
+
+	for i := first; i <= last; i++ {
+		vm.Push(table.At(i))
+	}
+
+	return int(last - first + 1), nil
+}
+
+// NewTableLibrary returns the table library, which is available as the global table.
+func NewTableLibrary() Value {
+	library := &Table{}
+	library.Put(NewString("pack"), NewFuntion(TablePack))
+	library.Put(NewString("unpack"), NewFuntion(TableUnpack))
+
+	return NewTable(library)
+}
+
+// maxStringSize limits the length of strings built by string.rep, so huge repetitions fail instead of
+// exhausting the memory.
+const maxStringSize = 1 << 30
+
+// StringLength returns the length of the string in bytes.
+func StringLength(vm *VM) (int, error) {
+	s, err := stringArg(vm, 0, "len")
+	if err != nil {
+		return 0, err
+	}
+
+	vm.Push(NewInteger(int64(len(s))))
+	return 1, nil
+}
+
+// StringLower returns a copy of the string with all letters changed to lower case.
+func StringLower(vm *VM) (int, error) {
+	s, err := stringArg(vm, 0, "lower")
+	if err != nil {
+		return 0, err
+	}
+
+	vm.Push(NewString(strings.ToLower(s)))
+	return 1, nil
+}
+
+// StringUpper returns a copy of the string with all letters changed to upper case.
+func StringUpper(vm *VM) (int, error) {
+	s, err := stringArg(vm, 0, "upper")
+	if err != nil {
+		return 0, err
+	}
+
+	vm.Push(NewString(strings.ToUpper(s)))
+	return 1, nil
+}
+
+// StringRep returns n copies of the string separated by the optional separator.
+func StringRep(vm *VM) (int, error) {
+	s, err := stringArg(vm, 0, "rep")
+	if err != nil {
+		return 0, err
+	}
+	n, err := integerArg(vm, 1, "rep")
+	if err != nil {
+		return 0, err
+	}
+	var separator string
+	if vm.Arg(2).valueType != TypeNil {
+		if separator, err = stringArg(vm, 2, "rep"); err != nil {
+			return 0, err
+		}
+	}
+
+	if n <= 0 || len(s)+len(separator) == 0 {
+		vm.Push(NewString(""))
+		return 1, nil
+	}
+	if int64(len(s)+len(separator)) > maxStringSize/n {
+		return 0, errors.New("resulting string too large")
+	}
+
+	var builder strings.Builder
+	builder.Grow(int(n)*(len(s)+len(separator)) - len(separator))
+	for i := range n {
+		if i > 0 {
+			builder.WriteString(separator)
+		}
+		builder.WriteString(s)
+	}
+
+	vm.Push(NewString(builder.String()))
+	return 1, nil
+}
+
+// StringSub returns the substring from index i to index j, which defaults to -1. Negative indexes count
+// from the end of the string, indexes outside of the string are clamped.
+func StringSub(vm *VM) (int, error) {
+	s, err := stringArg(vm, 0, "sub")
+	if err != nil {
+		return 0, err
+	}
+	first, err := integerArg(vm, 1, "sub")
+	if err != nil {
+		return 0, err
+	}
+	last := int64(-1)
+	if vm.Arg(2).valueType != TypeNil {
+		if last, err = integerArg(vm, 2, "sub"); err != nil {
+			return 0, err
+		}
+	}
+
+	length := int64(len(s))
+	if first < 0 {
+		first = max(length+first+1, 1)
+	} else if first == 0 {
+		first = 1
+	}
+	if last < 0 {
+		last = length + last + 1
+	} else if last > length {
+		last = length
+	}
+
+	if first > last {
+		vm.Push(NewString(""))
+	} else {
+		vm.Push(NewString(s[first-1 : last]))
+	}
+	return 1, nil
+}
+
+// NewStringLibrary returns the string library, which is available as the global string and as the
+// methods of strings.
+func NewStringLibrary() Value {
+	library := &Table{}
+	library.Put(NewString("len"), NewFuntion(StringLength))
+	library.Put(NewString("lower"), NewFuntion(StringLower))
+	library.Put(NewString("upper"), NewFuntion(StringUpper))
+	library.Put(NewString("rep"), NewFuntion(StringRep))
+	library.Put(NewString("sub"), NewFuntion(StringSub))
+
+	return NewTable(library)
+}
+
+// stringArg returns the argument at index as a string, numbers are converted.
+func stringArg(vm *VM, index int, functionName string) (string, error) {
+	arg := vm.Arg(index)
+	switch arg.valueType {
+	case TypeString:
+		return arg.inner.(string), nil
+	case TypeInteger:
+		return strconv.FormatInt(arg.integer(), 10), nil
+	case TypeFloat:
+		return formatFloat(arg.float()), nil
+	default:
+		return "", fmt.Errorf("bad argument #%v to '%v' (string expected, got %v)", index+1, functionName, arg.valueType)
+	}
+}
+
+// integerArg returns the argument at index as an integer, floats with an exact integer representation
+// are converted.
+func integerArg(vm *VM, index int, functionName string) (int64, error) {
+	arg := vm.Arg(index)
+	if integer, ok := arg.Integer(); ok {
+		return integer, nil
+	}
+	if float, ok := arg.Float(); ok {
+		if integer, ok := floatToInteger(float); ok {
+			return integer, nil
+		}
+		return 0, fmt.Errorf("bad argument #%v to '%v' (number has no integer representation)", index+1, functionName)
+	}
+
+	return 0, fmt.Errorf("bad argument #%v to '%v' (number expected, got %v)", index+1, functionName, arg.valueType)
+}
@@ -0,0 +1,148 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// forPrepare initializes a numeric for loop whose initial value, limit and step are stored at the stack
+// indexes base, base+1 and base+2. It reports whether the loop body is executed at least once.
+//
+// If initial value and step are integers, the loop is an integer loop and the limit is replaced with the
+// number of remaining iterations. Counting the iterations instead of comparing against the limit prevents
+// the loop from overflowing.
+func (v *VM) forPrepare(base int) (bool, error) {
+	initial, limit, step := v.stack[base], v.stack[base+1], v.stack[base+2]
+
+	if initial.valueType == TypeInteger && step.valueType == TypeInteger {
+		initialInteger, stepInteger := initial.integer(), step.integer()
+		if stepInteger == 0 {
+			return false, errors.New("'for' step is zero")
+		}
+
+		limitInteger, skip, err := forLimit(limit, initialInteger, stepInteger)
+		if err != nil || skip {
+			return false, err
+		}
+
+		var count uint64
+		if stepInteger > 0 {
+			count = uint64(limitInteger) - uint64(initialInteger)
+			if stepInteger != 1 {
+				count /= uint64(stepInteger)
+			}
+		} else {
+			count = uint64(initialInteger) - uint64(limitInteger)
+			// step+1 avoids negating math.MinInt64
+			count /= uint64(-(stepInteger + 1)) + 1
+		}
+
+		v.stack[base+1] = NewInteger(int64(count))
+		v.setStack(base+3, initial)
+		return true, nil
+	}
+
+	initialFloat, err := forFloat(initial, "initial value")
+	if err != nil {
+		return false, err
+	}
+	limitFloat, err := forFloat(limit, "limit")
+	if err != nil {
+		return false, err
+	}
+	stepFloat, err := forFloat(step, "step")
+	if err != nil {
+		return false, err
+	}
+	if stepFloat == 0 {
+		return false, errors.New("'for' step is zero")
+	}
+
+	if (stepFloat > 0 && limitFloat < initialFloat) || (stepFloat < 0 && initialFloat < limitFloat) {
+		return false, nil
+	}
+
+	v.stack[base] = NewFloat(initialFloat)
+	v.stack[base+1] = NewFloat(limitFloat)
+	v.stack[base+2] = NewFloat(stepFloat)
+	v.setStack(base+3, NewFloat(initialFloat))
+	return true, nil
+}
+
+// forLoop advances the loop prepared by forPrepare and reports whether the body is executed again.
+func (v *VM) forLoop(base int) bool {
+	if v.stack[base+2].valueType == TypeInteger {
+		count := uint64(v.stack[base+1].integer())
+		if count == 0 {
+			return false
+		}
+
+		index := NewInteger(v.stack[base].integer() + v.stack[base+2].integer())
+		v.stack[base+1] = NewInteger(int64(count - 1))
+		v.stack[base] = index
+		v.stack[base+3] = index
+		return true
+	}
+
+	step := v.stack[base+2].float()
+	limit := v.stack[base+1].float()
+	index := v.stack[base].float() + step
+
+	if (step > 0 && index <= limit) || (step < 0 && limit <= index) {
+		v.stack[base] = NewFloat(index)
+		v.stack[base+3] = NewFloat(index)
+		return true
+	}
+
+	return false
+}
+
+// forLimit converts the limit of an integer loop to an integer, floats are rounded towards the initial
+// value and clipped to the integer range. It reports whether the loop is skipped entirely.
+func forLimit(limit Value, initial, step int64) (int64, bool, error) {
+	var limitInteger int64
+	switch limit.valueType {
+	case TypeInteger:
+		limitInteger = limit.integer()
+	case TypeFloat:
+		limitFloat := limit.float()
+		if step < 0 {
+			limitFloat = math.Ceil(limitFloat)
+		} else {
+			limitFloat = math.Floor(limitFloat)
+		}
+
+		var ok bool
+		limitInteger, ok = floatToInteger(limitFloat)
+		if !ok {
+			// the float is out of the integer range
+			if limitFloat > 0 {
+				if step < 0 {
+					return 0, true, nil
+				}
+				limitInteger = math.MaxInt64
+			} else {
+				if step > 0 {
+					return 0, true, nil
+				}
+				limitInteger = math.MinInt64
+			}
+		}
+	default:
+		return 0, false, fmt.Errorf("'for' limit must be a number but is %v", limit.valueType)
+	}
+
+	if step > 0 {
+		return limitInteger, initial > limitInteger, nil
+	}
+	return limitInteger, initial < limitInteger, nil
+}
+
+func forFloat(value Value, name string) (float64, error) {
+	if !isNumber(value) {
+		return 0, fmt.Errorf("'for' %v must be a number but is %v", name, value.valueType)
+	}
+
+	return toFloat(value), nil
+}
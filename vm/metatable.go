@@ -0,0 +1,306 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// metatable returns the metatable of the value or nil if it has none. Tables have their own metatables,
+// the values of the other types share the metatable of their type.
+func (v *VM) metatable(value Value) *Table {
+	switch value.valueType {
+	case TypeTable:
+		return value.inner.(*Table).metatable
+	case TypeUserdata:
+		return value.inner.(*Userdata).metatable
+	default:
+		return v.typeMetatables[value.valueType]
+	}
+}
+
+// metamethod returns the field event of the value's metatable or nil if it has none.
+func (v *VM) metamethod(value Value, event string) Value {
+	metatable := v.metatable(value)
+	if metatable == nil {
+		return NewNil()
+	}
+
+	return metatable.Get(NewString(event))
+}
+
+// maxMetaChain limits the number of __index and __newindex values which are indexed in turn, so a loop
+// of metatables fails instead of running forever.
+const maxMetaChain = 2000
+
+// rawTable returns the table if the value is a table without a metatable, which is indexed without looking
+// up metamethods.
+func rawTable(value Value) (*Table, bool) {
+	if value.valueType != TypeTable {
+		return nil, false
+	}
+
+	table := value.inner.(*Table)
+	return table, table.metatable == nil
+}
+
+// getIndex stores value[key] at the register destination of frame.
+func (v *VM) getIndex(frame *callFrame, destination byte, value, key Value) error {
+	if table, ok := rawTable(value); ok {
+		v.stack[frame.base+int(destination)] = table.Get(key)
+		return nil
+	}
+
+	base := frame.base
+	result, err := v.index(value, key)
+	if err != nil {
+		return err
+	}
+
+	v.stack[base+int(destination)] = result
+	return nil
+}
+
+// index returns value[key]. If a table has no such field or the value is not a table, its __index
+// metamethod is used. A function is called with the value and the key, any other value is indexed
+// in turn.
+func (v *VM) index(value, key Value) (Value, error) {
+	for range maxMetaChain {
+		var handler Value
+		if value.valueType == TypeTable {
+			table := value.inner.(*Table)
+			result := table.Get(key)
+			if result.valueType != TypeNil || table.metatable == nil {
+				return result, nil
+			}
+
+			handler = table.metatable.Get(NewString("__index"))
+			if handler.valueType == TypeNil {
+				return result, nil
+			}
+		} else {
+			handler = v.metamethod(value, "__index")
+			if handler.valueType == TypeNil {
+				return Value{}, fmt.Errorf("attempt to index a %v value", value.valueType)
+			}
+		}
+
+		if handler.valueType == TypeFunction {
+			return v.callMetamethod(handler, value, key)
+		}
+		value = handler
+	}
+
+	return Value{}, errors.New("'__index' chain too long; possible loop")
+}
+
+// setIndex assigns newValue to value[key]. If a table has no such field or the value is not a table, its
+// __newindex metamethod is used. A function is called with the value, the key and the new value, any
+// other value is assigned to in turn.
+func (v *VM) setIndex(value, key, newValue Value) error {
+	for range maxMetaChain {
+		var handler Value
+		if value.valueType == TypeTable {
+			table := value.inner.(*Table)
+			if table.metatable == nil || table.Get(key).valueType != TypeNil {
+				return rawSet(table, key, newValue)
+			}
+
+			handler = table.metatable.Get(NewString("__newindex"))
+			if handler.valueType == TypeNil {
+				return rawSet(table, key, newValue)
+			}
+		} else {
+			handler = v.metamethod(value, "__newindex")
+			if handler.valueType == TypeNil {
+				return fmt.Errorf("attempt to index a %v value", value.valueType)
+			}
+		}
+
+		if handler.valueType == TypeFunction {
+			_, err := v.callMetamethod(handler, value, key, newValue)
+			return err
+		}
+		value = handler
+	}
+
+	return errors.New("'__newindex' chain too long; possible loop")
+}
+
+// binaryMetamethod calls the metamethod for event of a or, if a has none, of b with both operands and
+// returns its first result. If neither has one, nil and noMetamethod are returned.
+func (v *VM) binaryMetamethod(event string, a, b Value, noMetamethod error) (Value, error) {
+	metamethod := v.metamethod(a, event)
+	if metamethod.valueType == TypeNil {
+		metamethod = v.metamethod(b, event)
+	}
+	if metamethod.valueType == TypeNil {
+		return NewNil(), noMetamethod
+	}
+
+	return v.callMetamethod(metamethod, a, b)
+}
+
+// callMetamethod calls the metamethod with the arguments behind the values in use and returns its first
+// result.
+func (v *VM) callMetamethod(metamethod Value, args ...Value) (Value, error) {
+	first, err := v.callBehindTop(metamethod, 1, args...)
+	if err != nil {
+		return Value{}, err
+	}
+
+	return v.stack[first], nil
+}
+
+// callBehindTop calls the function with the arguments behind the values in use. It returns the stack index
+// of the first of the resultCount results.
+func (v *VM) callBehindTop(function Value, resultCount int, args ...Value) (int, error) {
+	top := v.top
+	if len(v.frames) > 0 {
+		frame := v.frames[len(v.frames)-1]
+		top = max(frame.base+frame.closure.prototype.MaxStackSize, top)
+	}
+
+	v.setStack(top, function)
+	for i, arg := range args {
+		v.setStack(top+1+i, arg)
+	}
+	if err := v.call(top, len(args), resultCount); err != nil {
+		return 0, err
+	}
+
+	return top, nil
+}
+
+// SetMetatable sets the metatable of its first argument, which has to be a table, to the second argument.
+// A nil metatable removes the metatable. Metatables with a __metatable field are protected and can not be
+// changed. The table is returned.
+func SetMetatable(vm *VM) (int, error) {
+	tableArg := vm.Arg(0)
+	if tableArg.valueType != TypeTable {
+		return 0, fmt.Errorf("bad argument #1 to 'setmetatable' (table expected, got %v)", tableArg.valueType)
+	}
+	table := tableArg.inner.(*Table)
+
+	metatableArg := vm.Arg(1)
+	var metatable *Table
+	switch metatableArg.valueType {
+	case TypeNil:
+	case TypeTable:
+		metatable = metatableArg.inner.(*Table)
+	default:
+		return 0, fmt.Errorf("bad argument #2 to 'setmetatable' (nil or table expected, got %v)", metatableArg.valueType)
+	}
+
+	if vm.metamethod(tableArg, "__metatable").valueType != TypeNil {
+		return 0, errors.New("cannot change a protected metatable")
+	}
+	table.metatable = metatable
+	if table.contents != nil {
+		table.contents.metatable = table.contentsMetatable()
+	}
+	table.setMode(metatable)
+	if metatable != nil && metatable.Get(NewString("__gc")).valueType != TypeNil {
+		vm.setFinalizer(tableArg)
+	}
+
+	vm.Push(tableArg)
+	return 1, nil
+}
+
+// GetMetatable returns the metatable of its argument or nil if it has none. If the metatable has a
+// __metatable field, its value is returned instead.
+func GetMetatable(vm *VM) (int, error) {
+	metatable := vm.metatable(vm.Arg(0))
+	if metatable == nil {
+		vm.Push(NewNil())
+		return 1, nil
+	}
+
+	if protected := metatable.Get(NewString("__metatable")); protected.valueType != TypeNil {
+		vm.Push(protected)
+	} else {
+		vm.Push(NewTable(metatable))
+	}
+	return 1, nil
+}
+
+// ToString converts its argument to a string. Values whose metatable has a __tostring field are converted
+// by calling it.
+func ToString(vm *VM) (int, error) {
+	str, err := vm.toString(vm.Arg(0))
+	if err != nil {
+		return 0, err
+	}
+
+	vm.Push(NewString(str))
+	return 1, nil
+}
+
+// toString converts the value to a string by its __tostring metamethod, which has to return a string, or
+// formats the value if it has none.
+func (v *VM) toString(value Value) (string, error) {
+	metamethod := v.metamethod(value, "__tostring")
+	if metamethod.valueType == TypeNil {
+		return value.String(), nil
+	}
+
+	result, err := v.callMetamethod(metamethod, value)
+	if err != nil {
+		return "", err
+	}
+	if result.valueType != TypeString {
+		return "", errors.New("'__tostring' must return a string")
+	}
+
+	return result.inner.(string), nil
+}
+
+// RawGet returns the field of its first argument, which has to be a table, at its second argument
+// without invoking the __index metamethod.
+func RawGet(vm *VM) (int, error) {
+	tableArg := vm.Arg(0)
+	if tableArg.valueType != TypeTable {
+		return 0, fmt.Errorf("bad argument #1 to 'rawget' (table expected, got %v)", tableArg.valueType)
+	}
+
+	vm.Push(tableArg.inner.(*Table).Get(vm.Arg(1)))
+	return 1, nil
+}
+
+// RawSet assigns its third argument to the field of its first argument, which has to be a table, at its
+// second argument without invoking the __newindex metamethod. The table is returned.
+func RawSet(vm *VM) (int, error) {
+	tableArg := vm.Arg(0)
+	if tableArg.valueType != TypeTable {
+		return 0, fmt.Errorf("bad argument #1 to 'rawset' (table expected, got %v)", tableArg.valueType)
+	}
+
+	if err := rawSet(tableArg.inner.(*Table), vm.Arg(1), vm.Arg(2)); err != nil {
+		return 0, err
+	}
+	vm.Push(tableArg)
+	return 1, nil
+}
+
+// rawSet assigns the value to the key of the table without invoking any metamethods.
+func rawSet(table *Table, key, value Value) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	table.Put(key, value)
+	return nil
+}
+
+// newStringMetatable returns the metatable shared by all strings. Its __index field refers to the string
+// library, so methods like s:upper() can be called on strings. The global string library is used if the
+// globals contain one, so functions added to it are available as methods as well.
+func newStringMetatable(globals map[string]Value) *Table {
+	library, ok := globals["string"]
+	if !ok || library.valueType != TypeTable {
+		library = NewStringLibrary()
+	}
+
+	metatable := &Table{}
+	metatable.Put(NewString("__index"), library)
+	return metatable
+}
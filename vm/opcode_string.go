@@ -33,11 +33,62 @@ func _() {
 	_ = x[OpCodeNot-22]
 	_ = x[OpCodeBitNot-23]
 	_ = x[OpCodeLength-24]
+	_ = x[OpCodeAdd-25]
+	_ = x[OpCodeAddConst-26]
+	_ = x[OpCodeSubtract-27]
+	_ = x[OpCodeSubtractConst-28]
+	_ = x[OpCodeMultiply-29]
+	_ = x[OpCodeMultiplyConst-30]
+	_ = x[OpCodeDivide-31]
+	_ = x[OpCodeDivideConst-32]
+	_ = x[OpCodeFloorDivide-33]
+	_ = x[OpCodeFloorDivideConst-34]
+	_ = x[OpCodeModulo-35]
+	_ = x[OpCodeModuloConst-36]
+	_ = x[OpCodePower-37]
+	_ = x[OpCodePowerConst-38]
+	_ = x[OpCodeEqual-39]
+	_ = x[OpCodeEqualConst-40]
+	_ = x[OpCodeNotEqual-41]
+	_ = x[OpCodeNotEqualConst-42]
+	_ = x[OpCodeLess-43]
+	_ = x[OpCodeLessConst-44]
+	_ = x[OpCodeLessEqual-45]
+	_ = x[OpCodeLessEqualConst-46]
+	_ = x[OpCodeGreaterConst-47]
+	_ = x[OpCodeGreaterEqualConst-48]
+	_ = x[OpCodeJump-49]
+	_ = x[OpCodeTest-50]
+	_ = x[OpCodeTestSet-51]
+	_ = x[OpCodeForPrepare-52]
+	_ = x[OpCodeForLoop-53]
+	_ = x[OpCodeGenericForPrepare-54]
+	_ = x[OpCodeGenericForCall-55]
+	_ = x[OpCodeGenericForLoop-56]
+	_ = x[OpCodeReturn-57]
+	_ = x[OpCodeClosure-58]
+	_ = x[OpCodeGetUpvalue-59]
+	_ = x[OpCodeSetUpvalue-60]
+	_ = x[OpCodeClose-61]
+	_ = x[OpCodeVararg-62]
+	_ = x[OpCodeSelf-63]
+	_ = x[OpCodeConcat-64]
+	_ = x[OpCodeBitAnd-65]
+	_ = x[OpCodeBitAndConst-66]
+	_ = x[OpCodeBitOr-67]
+	_ = x[OpCodeBitOrConst-68]
+	_ = x[OpCodeBitXor-69]
+	_ = x[OpCodeBitXorConst-70]
+	_ = x[OpCodeShiftLeft-71]
+	_ = x[OpCodeShiftLeftConst-72]
+	_ = x[OpCodeShiftRight-73]
+	_ = x[OpCodeShiftRightConst-74]
+	_ = x[OpCodeToBeClosed-75]
 }
 
-const _OpCode_name = "GetGlobalSetGlobalSetGlobalConstSetGlobalGlobalLoadConstCallLoadNilLoadBoolLoadIntMoveNewTableSetTableSetTableConstSetFieldSetFieldConstSetIntSetIntConstSetListGetTableGetFieldGetIntNegateNotBitNotLength"
+const _OpCode_name = "GetGlobalSetGlobalSetGlobalConstSetGlobalGlobalLoadConstCallLoadNilLoadBoolLoadIntMoveNewTableSetTableSetTableConstSetFieldSetFieldConstSetIntSetIntConstSetListGetTableGetFieldGetIntNegateNotBitNotLengthAddAddConstSubtractSubtractConstMultiplyMultiplyConstDivideDivideConstFloorDivideFloorDivideConstModuloModuloConstPowerPowerConstEqualEqualConstNotEqualNotEqualConstLessLessConstLessEqualLessEqualConstGreaterConstGreaterEqualConstJumpTestTestSetForPrepareForLoopGenericForPrepareGenericForCallGenericForLoopReturnClosureGetUpvalueSetUpvalueCloseVarargSelfConcatBitAndBitAndConstBitOrBitOrConstBitXorBitXorConstShiftLeftShiftLeftConstShiftRightShiftRightConstToBeClosed"
 
-var _OpCode_index = [...]uint8{0, 9, 18, 32, 47, 56, 60, 67, 75, 82, 86, 94, 102, 115, 123, 136, 142, 153, 160, 168, 176, 182, 188, 191, 197, 203}
+var _OpCode_index = [...]uint16{0, 9, 18, 32, 47, 56, 60, 67, 75, 82, 86, 94, 102, 115, 123, 136, 142, 153, 160, 168, 176, 182, 188, 191, 197, 203, 206, 214, 222, 235, 243, 256, 262, 273, 284, 300, 306, 317, 322, 332, 337, 347, 355, 368, 372, 381, 390, 404, 416, 433, 437, 441, 448, 458, 465, 482, 496, 510, 516, 523, 533, 543, 548, 554, 558, 564, 570, 581, 586, 596, 602, 613, 622, 636, 646, 661, 671}
 
 func (i OpCode) String() string {
 	idx := int(i) - 0
@@ -0,0 +1,496 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"math"
+	"math/bits"
+	"slices"
+	"strings"
+)
+
+// Table is a Lua table. Like in the reference implementation it consists of an array part, which holds
+// the values of the integer keys 1 to len(array), and a hash part for all other keys. Integer keys are
+// moved between both parts when the table is rehashed, so sequences are stored in the array part.
+type Table struct {
+	// array holds the value of key i at index i-1, it may contain nil values.
+	array []Value
+	// hashIndex maps the keys of the hash part to their position in entries.
+	hashIndex map[Value]int
+	// entries holds the hash part in insertion order, which makes traversing a table deterministic. Removed
+	// entries keep their key with a nil value until the next rehash, so a traversal can continue after them.
+	entries []tableEntry
+	// metatable defines the behavior of the table for operations it does not support itself, it may be nil.
+	metatable *Table
+	// weakKeys and weakValues are set by the __mode field of the metatable. Collectable keys and values of
+	// weak tables are stored as weak references, which do not keep them alive.
+	weakKeys, weakValues bool
+	// rehashSize is the number of entries at which the table is rehashed next.
+	rehashSize int
+	// contents holds the fields of a table with a __gc metamethod. The finalizer is called with the
+	// contents once the table has been collected, since Go can not pass it the collected table itself.
+	contents *Table
+}
+
+type tableEntry struct {
+	key, value Value
+}
+
+// minRehashSize is the smallest number of entries at which a table is rehashed.
+const minRehashSize = 4
+
+// selfReference is stored in the fields of a table instead of the table itself. Once the table gets a __gc
+// metamethod its fields move to its contents, which must not refer to the table, otherwise the table would
+// never be collected.
+var selfReference = Value{valueType: TypeTable, inner: selfReferenceMarker{}}
+
+type selfReferenceMarker struct{}
+
+// storage returns the table holding the fields, which is the table itself unless it has a finalizer.
+func (t *Table) storage() *Table {
+	if t.contents != nil {
+		return t.contents
+	}
+	return t
+}
+
+// encode replaces a reference of the table to itself before it is stored in its fields.
+func (t *Table) encode(value Value) Value {
+	if value.valueType == TypeTable && value.inner == any(t) {
+		return selfReference
+	}
+	return value
+}
+
+// decode resolves a self reference loaded from the fields of the table.
+func (t *Table) decode(value Value) Value {
+	if value == selfReference {
+		return NewTable(t)
+	}
+	return value
+}
+
+// contentsMetatable returns the metatable of the contents of a table with a finalizer. A table which is
+// its own metatable would be referred to by its contents, its contents take its place instead.
+func (t *Table) contentsMetatable() *Table {
+	if t.metatable == t {
+		return t.contents
+	}
+	return t.metatable
+}
+
+func (t *Table) String() string {
+	return t.format(map[*Table]bool{})
+}
+
+// format formats the table and the tables it contains. The keys of the array part come first in order,
+// followed by the keys of the hash part sorted by their formatted value. Tables which are already being
+// formatted are written as Table{...}, so tables containing themselves do not recurse endlessly.
+func (t *Table) format(formatting map[*Table]bool) string {
+	if t.metatable != nil {
+		if name := t.metatable.Get(NewString("__name")); name.valueType == TypeString {
+			// the contents are passed to the finalizer, so it can recognize the table by its address
+			return fmt.Sprintf("%v: %p", name.inner, t.storage())
+		}
+	}
+	if formatting[t] {
+		return "Table{...}"
+	}
+	formatting[t] = true
+	defer delete(formatting, t)
+
+	// All yields the fields of the array part first
+	storage, arrayCount := t.storage(), 0
+	for _, value := range storage.array {
+		if storage.load(value).valueType != TypeNil {
+			arrayCount++
+		}
+	}
+	var fields [][2]string
+	for key, value := range t.All() {
+		fields = append(fields, [2]string{formatValue(key, formatting), formatValue(value, formatting)})
+	}
+	slices.SortStableFunc(fields[arrayCount:], func(a, b [2]string) int {
+		return strings.Compare(a[0], b[0])
+	})
+
+	var stringBuilder strings.Builder
+
+	stringBuilder.WriteString("Table{")
+
+	for _, field := range fields {
+		fmt.Fprintf(&stringBuilder, "%v=%v,", field[0], field[1])
+	}
+
+	str := stringBuilder.String()
+	str = strings.TrimSuffix(str, ",")
+	str += "}"
+
+	return str
+}
+
+func formatValue(value Value, formatting map[*Table]bool) string {
+	if value.valueType == TypeTable {
+		return value.inner.(*Table).format(formatting)
+	}
+
+	return value.String()
+}
+
+// normalizeKey converts float keys with an integer value to integers, so t[1.0] and t[1] are the same field.
+func normalizeKey(key Value) Value {
+	if float, ok := key.Float(); ok {
+		if integer, ok := floatToInteger(float); ok {
+			return NewInteger(integer)
+		}
+	}
+	return key
+}
+
+// checkKey returns an error if the value can not be used as a key of a table.
+func checkKey(key Value) error {
+	if key.valueType == TypeNil {
+		return errors.New("index is nil")
+	}
+	if float, ok := key.Float(); ok && math.IsNaN(float) {
+		return errors.New("index is NaN")
+	}
+	return nil
+}
+
+// load returns the value stored in the table, weak references are resolved.
+func (t *Table) load(value Value) Value {
+	if t.weakValues {
+		return strengthen(value)
+	}
+	return value
+}
+
+func (t *Table) Get(key Value) Value {
+	return t.decode(t.storage().get(t.encode(key)))
+}
+
+func (t *Table) get(key Value) Value {
+	key = normalizeKey(key)
+	if index, ok := key.Integer(); ok {
+		return t.at(index)
+	}
+
+	if t.weakKeys {
+		key = weaken(key)
+	}
+	return t.getHash(key)
+}
+
+// At returns the value of the integer key index.
+func (t *Table) At(index int64) Value {
+	return t.decode(t.storage().at(index))
+}
+
+func (t *Table) at(index int64) Value {
+	if index >= 1 && index <= int64(len(t.array)) {
+		return t.load(t.array[index-1])
+	}
+
+	return t.getHash(NewInteger(index))
+}
+
+// getHash returns the value of the key in the hash part, the key has to be normalized and weakened already.
+func (t *Table) getHash(key Value) Value {
+	position, ok := t.hashIndex[key]
+	if !ok {
+		return NewNil()
+	}
+	return t.load(t.entries[position].value)
+}
+
+// Put assigns the value to the key, assigning nil removes the field. Keys must not be nil or NaN.
+func (t *Table) Put(key, value Value) {
+	t.storage().put(t.encode(key), t.encode(value))
+}
+
+func (t *Table) put(key, value Value) {
+	key = normalizeKey(key)
+	if index, ok := key.Integer(); ok {
+		t.set(index, value)
+		return
+	}
+
+	if t.weakKeys {
+		key = weaken(key)
+	}
+	t.putHash(key, value)
+}
+
+// Set assigns the value to the integer key index. Assigning the key following the array part appends to
+// it and moves the keys following it from the hash part.
+func (t *Table) Set(index int64, value Value) {
+	t.storage().set(index, t.encode(value))
+}
+
+func (t *Table) set(index int64, value Value) {
+	switch {
+	case index >= 1 && index <= int64(len(t.array)):
+		if t.weakValues {
+			value = weaken(value)
+		}
+		t.array[index-1] = value
+
+	case index == int64(len(t.array))+1 && value.valueType != TypeNil:
+		t.add(value)
+
+	default:
+		t.putHash(NewInteger(index), value)
+	}
+}
+
+// Add appends the value to the array part.
+func (t *Table) Add(value Value) {
+	t.storage().add(t.encode(value))
+}
+
+func (t *Table) add(value Value) {
+	if t.weakValues {
+		value = weaken(value)
+	}
+	// a rehash which shrank the array part may have left the appended key in the hash part
+	if position, ok := t.hashIndex[NewInteger(int64(len(t.array))+1)]; ok {
+		t.entries[position].value = NewNil()
+	}
+	t.array = append(t.array, value)
+
+	// the following keys may have been assigned before, they belong to the array part now
+	for len(t.hashIndex) > 0 {
+		key := NewInteger(int64(len(t.array)) + 1)
+		position, ok := t.hashIndex[key]
+		if !ok || t.entries[position].value.valueType == TypeNil {
+			return
+		}
+		t.array = append(t.array, t.entries[position].value)
+		t.entries[position].value = NewNil()
+	}
+}
+
+// putHash stores the value in the hash part, the key has to be normalized and weakened already. Adding a
+// key to a full hash part rehashes the table.
+func (t *Table) putHash(key, value Value) {
+	if t.weakValues {
+		value = weaken(value)
+	}
+	if position, ok := t.hashIndex[key]; ok {
+		t.entries[position].value = value
+		return
+	}
+	if value.valueType == TypeNil {
+		return
+	}
+
+	t.appendEntry(key, value)
+	if len(t.entries) > t.rehashSize {
+		t.rehash()
+	}
+}
+
+// appendEntry adds the key, which must not be in use, to the end of the hash part.
+func (t *Table) appendEntry(key, value Value) {
+	if t.hashIndex == nil {
+		t.hashIndex = map[Value]int{}
+	}
+	t.hashIndex[key] = len(t.entries)
+	t.entries = append(t.entries, tableEntry{key, value})
+}
+
+// rehash resizes the array part to the largest size n for which more than half of the keys 1 to n are in
+// use, like the reference implementation does. Integer keys are moved between the parts accordingly and
+// removed entries are dropped from the hash part.
+func (t *Table) rehash() {
+	t.sweep()
+	t.compact()
+
+	// counts[i] is the number of integer keys k with 2^(i-1) < k <= 2^i
+	var counts [64]int
+	total := 0
+	for i, value := range t.array {
+		if t.load(value).valueType != TypeNil {
+			counts[ceilLog2(uint64(i+1))]++
+			total++
+		}
+	}
+	for _, entry := range t.entries {
+		if index, ok := entry.key.Integer(); ok && index >= 1 {
+			counts[ceilLog2(uint64(index))]++
+			total++
+		}
+	}
+
+	size, used := 0, 0
+	for i, power := 0, 1; i < len(counts) && total > power/2; i, power = i+1, power*2 {
+		used += counts[i]
+		if used > power/2 {
+			size = power
+		}
+	}
+	t.resizeArray(size)
+	t.compact()
+
+	t.rehashSize = max(minRehashSize, 2*len(t.entries))
+}
+
+// resizeArray moves the integer keys beyond size from the array to the hash part and the keys up to size
+// from the hash to the array part. The hash part has to be compacted before.
+func (t *Table) resizeArray(size int) {
+	if size < len(t.array) {
+		for i, value := range t.array[size:] {
+			if t.load(value).valueType != TypeNil {
+				t.appendEntry(NewInteger(int64(size+i+1)), value)
+			}
+		}
+		t.array = slices.Clip(t.array[:size])
+		return
+	}
+
+	oldSize := len(t.array)
+	t.array = slices.Grow(t.array, size-oldSize)
+	for range size - oldSize {
+		t.array = append(t.array, NewNil())
+	}
+	for i, entry := range t.entries {
+		if index, ok := entry.key.Integer(); ok && index > int64(oldSize) && index <= int64(size) {
+			t.array[index-1] = entry.value
+			t.entries[i].value = NewNil()
+		}
+	}
+}
+
+// compact drops the removed entries from the hash part, the order of the others is kept.
+func (t *Table) compact() {
+	entries := t.entries[:0]
+	for _, entry := range t.entries {
+		if entry.value.valueType == TypeNil {
+			delete(t.hashIndex, entry.key)
+			continue
+		}
+		t.hashIndex[entry.key] = len(entries)
+		entries = append(entries, entry)
+	}
+	clear(t.entries[len(entries):])
+	t.entries = entries
+}
+
+// Next returns the field following key in the traversal order of the table, which is the first field for
+// a nil key. The array part is traversed first, followed by the hash part in insertion order. A nil key is
+// returned after the last field. It reports false if the key is not in the table.
+func (t *Table) Next(key Value) (Value, Value, bool) {
+	key, value, ok := t.storage().next(t.encode(key))
+	return t.decode(key), t.decode(value), ok
+}
+
+func (t *Table) next(key Value) (Value, Value, bool) {
+	// position counts the array part followed by the entries of the hash part
+	position := 0
+	if key.valueType != TypeNil {
+		key = normalizeKey(key)
+		if index, ok := key.Integer(); ok && index >= 1 && index <= int64(len(t.array)) {
+			position = int(index)
+		} else {
+			if t.weakKeys {
+				key = weaken(key)
+			}
+			entry, ok := t.hashIndex[key]
+			if !ok {
+				return NewNil(), NewNil(), false
+			}
+			position = len(t.array) + entry + 1
+		}
+	}
+
+	for ; position < len(t.array); position++ {
+		if value := t.load(t.array[position]); value.valueType != TypeNil {
+			return NewInteger(int64(position) + 1), value, true
+		}
+	}
+	for _, entry := range t.entries[position-len(t.array):] {
+		key, value := strengthen(entry.key), t.load(entry.value)
+		if key.valueType != TypeNil && value.valueType != TypeNil {
+			return key, value, true
+		}
+	}
+
+	return NewNil(), NewNil(), true
+}
+
+// All returns an iterator over the fields of the table in the order of Next.
+func (t *Table) All() iter.Seq2[Value, Value] {
+	return func(yield func(Value, Value) bool) {
+		key := NewNil()
+		for {
+			var value Value
+			key, value, _ = t.Next(key)
+			if key.valueType == TypeNil || !yield(key, value) {
+				return
+			}
+		}
+	}
+}
+
+// ceilLog2 returns the smallest i with x <= 2^i.
+func ceilLog2(x uint64) int {
+	return bits.Len64(x - 1)
+}
+
+// Length returns a border of the table, which is a non-negative integer n where t[n] is not nil and
+// t[n+1] is nil, or 0 if t[1] is nil. If the table has holes, any of its borders may be returned.
+func (t *Table) Length() int {
+	return t.storage().length()
+}
+
+func (t *Table) length() int {
+	size := len(t.array)
+	if size > 0 && t.load(t.array[size-1]).valueType == TypeNil {
+		// there is a border in the array part, t[low] is not nil or low is 0 and t[high] is nil
+		low, high := 0, size
+		for high-low > 1 {
+			middle := (low + high) / 2
+			if t.load(t.array[middle-1]).valueType == TypeNil {
+				high = middle
+			} else {
+				low = middle
+			}
+		}
+		return low
+	}
+
+	if t.at(int64(size)+1).valueType == TypeNil {
+		return size
+	}
+	return t.hashBorder(int64(size) + 1)
+}
+
+// hashBorder searches a border in the hash part beyond the key present, whose value is not nil.
+func (t *Table) hashBorder(present int64) int {
+	// find a key whose value is nil by doubling the key
+	low, high := present, present*2
+	for t.at(high).valueType != TypeNil {
+		low = high
+		if high > math.MaxInt64/2 {
+			// the table is a pathological sequence, search linearly from the start
+			border := int64(1)
+			for t.at(border).valueType != TypeNil {
+				border++
+			}
+			return int(border - 1)
+		}
+		high *= 2
+	}
+
+	for high-low > 1 {
+		middle := low + (high-low)/2
+		if t.at(middle).valueType == TypeNil {
+			high = middle
+		} else {
+			low = middle
+		}
+	}
+	return int(low)
+}
@@ -8,18 +8,19 @@ func _() {
 	// An "invalid array index" compiler error signifies that the constant values have changed.
 	// Re-run the stringer command to generate them again.
 	var x [1]struct{}
-	_ = x[TypeString-0]
-	_ = x[TypeFloat-1]
-	_ = x[TypeInteger-2]
-	_ = x[TypeFunction-3]
-	_ = x[TypeBoolean-4]
-	_ = x[TypeNil-5]
+	_ = x[TypeNil-0]
+	_ = x[TypeString-1]
+	_ = x[TypeFloat-2]
+	_ = x[TypeInteger-3]
+	_ = x[TypeFunction-4]
+	_ = x[TypeBoolean-5]
 	_ = x[TypeTable-6]
+	_ = x[TypeUserdata-7]
 }
 
-const _Type_name = "StringFloatIntegerFunctionBooleanNilTable"
+const _Type_name = "NilStringFloatIntegerFunctionBooleanTableUserdata"
 
-var _Type_index = [...]uint8{0, 6, 11, 18, 26, 33, 36, 41}
+var _Type_index = [...]uint8{0, 3, 9, 14, 21, 29, 36, 41, 49}
 
 func (i Type) String() string {
 	idx := int(i) - 0
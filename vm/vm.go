@@ -5,60 +5,167 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log/slog"
 	"luingo/logging"
-	"maps"
-	"slices"
-	"strings"
+	"math"
+	"strconv"
+	"sync/atomic"
 )
 
-type vmFunc func(*VM) int
+// vmFunc is a function implemented in Go. It reads its arguments with Arg, pushes its results with Push
+// and returns how many results it pushed.
+type vmFunc func(*VM) (int, error)
 
 type VM struct {
 	globals   map[string]Value
 	stack     []Value
+	frames    []callFrame
 	funcIndex int
-
-	out io.Writer
+	top       int
+
+	// openUpvalues are the upvalues of locals which are still in scope, sorted by their stack index.
+	openUpvalues []*upvalue
+	// toBeClosed are the stack indexes of the close locals which are still in scope, in ascending order.
+	toBeClosed []int
+	// finalizersPending is set once objects with a __gc metamethod have been collected.
+	finalizersPending *atomic.Bool
+	// finalizable are the objects with a __gc metamethod which have not been finalized yet.
+	finalizable []finalizable
+	// finalizing is set while finalizers run, so they are not run again by nested calls.
+	finalizing bool
+	// typeMetatables are the metatables shared by all values of a type except for tables, which have their own.
+	typeMetatables map[Type]*Table
+
+	out    io.Writer
+	logger *slog.Logger
+	debug  bool
 }
 
 func NewVM(globals map[string]Value, stdOut io.Writer) *VM {
-	return &VM{globals: globals, out: stdOut}
+	return &VM{
+		globals:           globals,
+		typeMetatables:    map[Type]*Table{TypeString: newStringMetatable(globals)},
+		finalizersPending: &atomic.Bool{},
+		out:               stdOut,
+	}
 }
 
-func (v *VM) Execute(ctx context.Context, constants []Value, byteCodes []ByteCode) error {
-	logger := logging.Logger(ctx)
+// Execute runs the prototype of a compiled chunk as the main function.
+func (v *VM) Execute(ctx context.Context, prototype *Prototype) error {
+	v.logger = logging.Logger(ctx)
+	v.debug = v.logger.Enabled(ctx, slog.LevelDebug)
+
+	v.frames = v.frames[:0]
+	v.openUpvalues = v.openUpvalues[:0]
+	v.toBeClosed = v.toBeClosed[:0]
+	v.setStack(0, Value{valueType: TypeFunction, inner: &closure{prototype: prototype}})
+
+	err := v.call(0, 0, 0)
+	v.finalizeAll()
+	return err
+}
 
-	for byteCodeIndex, byteCode := range byteCodes {
+// step executes a single byte code of the function in frame. Byte codes which call functions may grow the
+// stack, so the registers of the frame have to be looked up again after a call.
+func (v *VM) step(frame *callFrame, byteCode ByteCode) error {
+	registers := v.stack[frame.base:]
+	constants := frame.closure.prototype.Constants
 
-		var stringBuilder strings.Builder
-		if err := v.step(byteCode, constants); err != nil {
-			return fmt.Errorf("executing %+v: %w", byteCode, err)
+	switch byteCode.opCode {
+	case OpCodeCall:
+		funcIndex := frame.base + int(byteCode.args[0])
+		argCount := int(byteCode.args[1])
+		if byteCode.args[1] == VariableCount {
+			argCount = v.top - funcIndex - 1
+		}
+		resultCount := int(byteCode.args[2])
+		if byteCode.args[2] == VariableCount {
+			resultCount = multipleResults
 		}
 
-		stringBuilder.WriteString("Stack: ")
-		for stackIndex, value := range v.stack {
-			fmt.Fprintf(&stringBuilder, "%v=[%v] ", stackIndex, value)
+		_, err := v.prepareCall(funcIndex, argCount, resultCount)
+		return err
+
+	case OpCodeReturn:
+		first := frame.base + int(byteCode.args[0])
+		count := int(byteCode.args[1])
+		if byteCode.args[1] == VariableCount {
+			count = v.top - first
 		}
 
-		logger.Debug(fmt.Sprintf("Step %v. %+v %v", byteCodeIndex, byteCode, stringBuilder.String()))
-	}
+		// the close metamethods are called behind the results
+		top := max(frame.base+frame.closure.prototype.MaxStackSize, first+count)
+		if err := v.closeVariables(frame.base, NewNil(), top); err != nil {
+			return err
+		}
 
-	return nil
-}
+		v.returnResults(first, count)
 
-func (v *VM) step(byteCode ByteCode, constants []Value) error {
-	switch byteCode.opCode {
-	case OpCodeCall:
+	case OpCodeClosure:
 		stackIndex := byteCode.args[0]
-		v.funcIndex = int(stackIndex)
+		prototype := frame.closure.prototype.Prototypes[byteCode.args[1]]
+
+		registers[stackIndex] = Value{valueType: TypeFunction, inner: v.newClosure(frame, prototype)}
+
+	case OpCodeGetUpvalue:
+		stackIndex := byteCode.args[0]
+		upvalueIndex := byteCode.args[1]
+
+		registers[stackIndex] = frame.closure.upvalues[upvalueIndex].get(v.stack)
 
-		stackItem := v.stack[stackIndex]
-		if stackItem.valueType != TypeFunction {
-			return fmt.Errorf("expected %v. stack item to be a function but it is of type %v", stackIndex, stackItem.valueType)
+	case OpCodeSetUpvalue:
+		upvalueIndex := byteCode.args[0]
+		stackIndex := byteCode.args[1]
+
+		frame.closure.upvalues[upvalueIndex].set(v.stack, registers[stackIndex])
+
+	case OpCodeVararg:
+		count := int(byteCode.args[1])
+		if byteCode.args[1] == VariableCount {
+			count = multipleResults
 		}
 
-		function := stackItem.inner.(vmFunc)
-		_ = function(v)
+		v.varargs(frame, frame.base+int(byteCode.args[0]), count)
+
+	case OpCodeSelf:
+		destination := byteCode.args[0]
+		tableStackIndex := byteCode.args[1]
+		keyConstIndex := byteCode.args[2]
+
+		receiver := registers[tableStackIndex]
+		if err := v.getIndex(frame, destination, receiver, constants[keyConstIndex]); err != nil {
+			return err
+		}
+		v.stack[frame.base+int(destination)+1] = receiver
+
+	case OpCodeConcat:
+		first := int(byteCode.args[1])
+		count := int(byteCode.args[2])
+
+		result, err := Concat(registers[first : first+count])
+		if err != nil {
+			// values which are neither strings nor numbers may be concatenated by a metamethod
+			base := frame.base
+			if result, err = v.concat(registers[first : first+count]); err != nil {
+				return err
+			}
+			v.stack[base+int(byteCode.args[0])] = result
+			break
+		}
+		registers[byteCode.args[0]] = result
+
+	case OpCodeClose:
+		level := frame.base + int(byteCode.args[0])
+		v.closeUpvalues(level)
+		if err := v.closeVariables(level, NewNil(), frame.base+frame.closure.prototype.MaxStackSize); err != nil {
+			return err
+		}
+
+	case OpCodeToBeClosed:
+		name := constants[byteCode.args[1]].inner.(string)
+		if err := v.markToBeClosed(frame.base+int(byteCode.args[0]), name); err != nil {
+			return err
+		}
 
 	case OpCodeGetGlobal:
 		globalIndex := byteCode.args[1]
@@ -76,7 +183,7 @@ func (v *VM) step(byteCode ByteCode, constants []Value) error {
 
 		stackIndex := byteCode.args[0]
 
-		v.setStack(int(stackIndex), global)
+		registers[stackIndex] = global
 
 	case OpCodeSetGlobal:
 		globalIndex := byteCode.args[0]
@@ -86,7 +193,7 @@ func (v *VM) step(byteCode ByteCode, constants []Value) error {
 		}
 
 		stackIndex := byteCode.args[1]
-		v.globals[constant.String()] = v.stack[stackIndex]
+		v.globals[constant.String()] = registers[stackIndex]
 
 	case OpCodeSetGlobalGlobal:
 		globalIndex := byteCode.args[0]
@@ -120,123 +227,111 @@ func (v *VM) step(byteCode ByteCode, constants []Value) error {
 		stackIndex := byteCode.args[0]
 		constIndex := byteCode.args[1]
 
-		v.setStack(int(stackIndex), constants[constIndex])
+		registers[stackIndex] = constants[constIndex]
 
 	case OpCodeLoadNil:
 		stackIndex := byteCode.args[0]
-		v.setStack(int(stackIndex), NewNil())
+		registers[stackIndex] = NewNil()
 
 	case OpCodeLoadBool:
 		stackIndex := byteCode.args[0]
 		isTrue := byteCode.args[1] == 1
-		v.setStack(int(stackIndex), NewBoolean(isTrue))
+		registers[stackIndex] = NewBoolean(isTrue)
 
 	case OpCodeLoadInt:
 		stackIndex := byteCode.args[0]
 
 		integer := int16(binary.BigEndian.Uint16(byteCode.args[1:]))
 
-		v.setStack(int(stackIndex), NewInteger(int64(integer)))
+		registers[stackIndex] = NewInteger(int64(integer))
 
 	case OpCodeMove:
 		destinationIndex := byteCode.args[0]
 		sourceIndex := byteCode.args[1]
-		v.setStack(int(destinationIndex), v.stack[sourceIndex])
+		registers[destinationIndex] = registers[sourceIndex]
 
 	case OpCodeNewTable:
 		stackIndex := byteCode.args[0]
 		listSize := byteCode.args[1]
 		tableSize := byteCode.args[2]
-		v.setStack(int(stackIndex), NewTable(&Table{make([]Value, 0, listSize), make(map[Value]Value, tableSize)}))
+		registers[stackIndex] = NewTable(&Table{
+			array:      make([]Value, 0, listSize),
+			hashIndex:  make(map[Value]int, tableSize),
+			entries:    make([]tableEntry, 0, tableSize),
+			rehashSize: max(minRehashSize, int(tableSize)),
+		})
 
 	case OpCodeSetTable:
 		tableStackIndex := byteCode.args[0]
 		keyStackIndex := byteCode.args[1]
 		valueStackIndex := byteCode.args[2]
 
-		table, err := v.getTable(tableStackIndex)
-		if err != nil {
-			return err
-		}
-		key := v.stack[keyStackIndex]
-		value := v.stack[valueStackIndex]
-		table.Put(key, value)
+		return v.setIndex(registers[tableStackIndex], registers[keyStackIndex], registers[valueStackIndex])
 
 	case OpCodeSetTableConst:
 		tableStackIndex := byteCode.args[0]
 		keyStackIndex := byteCode.args[1]
 		valueConstIndex := byteCode.args[2]
 
-		table, err := v.getTable(tableStackIndex)
-		if err != nil {
-			return err
-		}
-		key := v.stack[keyStackIndex]
-		value := constants[valueConstIndex]
-		table.Put(key, value)
+		return v.setIndex(registers[tableStackIndex], registers[keyStackIndex], constants[valueConstIndex])
 
 	case OpCodeSetField:
 		tableStackIndex := byteCode.args[0]
 		keyConstIndex := byteCode.args[1]
 		valueStackIndex := byteCode.args[2]
 
-		table, err := v.getTable(tableStackIndex)
-		if err != nil {
-			return err
-		}
-		key := constants[keyConstIndex]
-		value := v.stack[valueStackIndex]
-		table.Put(key, value)
+		return v.setIndex(registers[tableStackIndex], constants[keyConstIndex], registers[valueStackIndex])
 
 	case OpCodeSetFieldConst:
 		tableStackIndex := byteCode.args[0]
 		keyConstIndex := byteCode.args[1]
 		valueConstIndex := byteCode.args[2]
 
-		table, err := v.getTable(tableStackIndex)
-		if err != nil {
-			return err
-		}
-		key := constants[keyConstIndex]
-		value := constants[valueConstIndex]
-		table.Put(key, value)
+		return v.setIndex(registers[tableStackIndex], constants[keyConstIndex], constants[valueConstIndex])
 
 	case OpCodeSetInt:
 		tableStackIndex := byteCode.args[0]
 		listIndex := byteCode.args[1]
 		valueStackIndex := byteCode.args[2]
 
-		table, err := v.getTable(tableStackIndex)
-		if err != nil {
-			return err
+		tableValue := registers[tableStackIndex]
+		value := registers[valueStackIndex]
+		if table, ok := rawTable(tableValue); ok {
+			table.Set(int64(listIndex), value)
+			break
 		}
-		value := v.stack[valueStackIndex]
-		table.Set(int64(listIndex), value)
+		return v.setIndex(tableValue, NewInteger(int64(listIndex)), value)
 
 	case OpCodeSetIntConst:
 		tableStackIndex := byteCode.args[0]
 		listIndex := byteCode.args[1]
 		valueConstIndex := byteCode.args[2]
 
-		table, err := v.getTable(tableStackIndex)
-		if err != nil {
-			return err
-		}
+		tableValue := registers[tableStackIndex]
 		value := constants[valueConstIndex]
-		table.Set(int64(listIndex), value)
+		if table, ok := rawTable(tableValue); ok {
+			table.Set(int64(listIndex), value)
+			break
+		}
+		return v.setIndex(tableValue, NewInteger(int64(listIndex)), value)
 
 	case OpCodeSetList:
 		tableStackIndex := byteCode.args[0]
-		listSize := byteCode.args[1]
+		listSize := int(byteCode.args[1])
+		if byteCode.args[1] == VariableCount {
+			listSize = v.top - frame.base - int(tableStackIndex) - 1
+		}
 
-		table, err := v.getTable(tableStackIndex)
+		table, err := getTable(registers, tableStackIndex)
 		if err != nil {
 			return err
 		}
 
-		for i := tableStackIndex + 1; i < tableStackIndex+1+listSize; i++ {
-			table.Add(v.stack[i])
-			v.stack[i] = Value{}
+		// the items of earlier batches already hold the keys up to ListBatchSize times the batch number
+		first := int64(byteCode.args[2]) * ListBatchSize
+		for i := 1; i <= listSize; i++ {
+			table.Set(first+int64(i), registers[int(tableStackIndex)+i])
+			registers[int(tableStackIndex)+i] = NewNil()
 		}
 
 	case OpCodeGetTable:
@@ -244,100 +339,236 @@ func (v *VM) step(byteCode ByteCode, constants []Value) error {
 		tableStackIndex := byteCode.args[1]
 		keyStackIndex := byteCode.args[2]
 
-		table, err := v.getTable(tableStackIndex)
-		if err != nil {
-			return err
-		}
-		keyValue := v.stack[keyStackIndex]
-
-		v.setStack(int(destination), table.Get(keyValue))
+		return v.getIndex(frame, destination, registers[tableStackIndex], registers[keyStackIndex])
 
 	case OpCodeGetInt:
 		destination := byteCode.args[0]
 		tableStackIndex := byteCode.args[1]
 		listIndex := byteCode.args[2]
 
-		table, err := v.getTable(tableStackIndex)
-		if err != nil {
-			return err
+		tableValue := registers[tableStackIndex]
+		if table, ok := rawTable(tableValue); ok {
+			registers[destination] = table.At(int64(listIndex))
+			break
 		}
-
-		v.setStack(int(destination), table.At(int64(listIndex)))
+		return v.getIndex(frame, destination, tableValue, NewInteger(int64(listIndex)))
 
 	case OpCodeGetField:
 		destination := byteCode.args[0]
 		tableStackIndex := byteCode.args[1]
 		keyConstIndex := byteCode.args[2]
 
-		table, err := v.getTable(tableStackIndex)
-		if err != nil {
-			return err
-		}
-		keyValue := constants[keyConstIndex]
-
-		v.setStack(int(destination), table.Get(keyValue))
+		return v.getIndex(frame, destination, registers[tableStackIndex], constants[keyConstIndex])
 
 	case OpCodeNegate:
 		destinationStackIndex := byteCode.args[0]
 		sourceStackIndex := byteCode.args[1]
 
-		value := v.stack[sourceStackIndex]
+		value := registers[sourceStackIndex]
 		switch value.valueType {
 		case TypeInteger:
-			value = NewInteger(-value.inner.(int64))
+			value = NewInteger(-value.integer())
 		case TypeFloat:
-			value = NewFloat(-value.inner.(float64))
+			value = NewFloat(-value.float())
 		default:
-			return fmt.Errorf("Can not negate %v", value.valueType)
+			base := frame.base
+			result, err := v.binaryMetamethod("__unm", value, value, fmt.Errorf("Can not negate %v", value.valueType))
+			if err != nil {
+				return err
+			}
+			v.stack[base+int(destinationStackIndex)] = result
+			return nil
 		}
 
-		v.setStack(int(destinationStackIndex), value)
+		registers[destinationStackIndex] = value
 
 	case OpCodeNot:
 		destinationStackIndex := byteCode.args[0]
 		sourceStackIndex := byteCode.args[1]
 
-		value := v.stack[sourceStackIndex]
-		switch value.valueType {
-		case TypeNil:
-			value = NewBoolean(true)
-		case TypeBoolean:
-			value = NewBoolean(!value.inner.(bool))
-		default:
-			value = NewBoolean(false)
-		}
+		value := NewBoolean(!registers[sourceStackIndex].IsTruthy())
 
-		v.setStack(int(destinationStackIndex), value)
+		registers[destinationStackIndex] = value
 
 	case OpCodeBitNot:
 		destinationStackIndex := byteCode.args[0]
 		sourceStackIndex := byteCode.args[1]
 
-		value := v.stack[sourceStackIndex]
-		switch value.valueType {
-		case TypeInteger:
-			value = NewInteger(^value.inner.(int64))
-		default:
-			return fmt.Errorf("Can not apply bitwise not to %v", value.valueType)
+		value := registers[sourceStackIndex]
+		integer, err := toInteger(value)
+		if err != nil {
+			base := frame.base
+			result, err := v.binaryMetamethod("__bnot", value, value, err)
+			if err != nil {
+				return err
+			}
+			v.stack[base+int(destinationStackIndex)] = result
+			return nil
 		}
 
-		v.setStack(int(destinationStackIndex), value)
+		registers[destinationStackIndex] = NewInteger(^integer)
 
 	case OpCodeLength:
 		destinationStackIndex := byteCode.args[0]
 		sourceStackIndex := byteCode.args[1]
 
-		value := v.stack[sourceStackIndex]
-		switch value.valueType {
-		case TypeString:
-			value = NewInteger(int64(len(value.inner.(string))))
-		case TypeTable:
-			value = NewInteger(int64(value.inner.(*Table).Length()))
-		default:
+		value := registers[sourceStackIndex]
+		if value.valueType == TypeString {
+			registers[destinationStackIndex] = NewInteger(int64(len(value.inner.(string))))
+			break
+		}
+
+		// tables with a metatable and other values may define their length by the __len metamethod
+		if metamethod := v.metamethod(value, "__len"); metamethod.valueType != TypeNil {
+			base := frame.base
+			result, err := v.callMetamethod(metamethod, value, value)
+			if err != nil {
+				return err
+			}
+			v.stack[base+int(destinationStackIndex)] = result
+			break
+		}
+		if value.valueType != TypeTable {
 			return fmt.Errorf("Can not get length for %v", value.valueType)
 		}
 
-		v.setStack(int(destinationStackIndex), value)
+		registers[destinationStackIndex] = NewInteger(int64(value.inner.(*Table).Length()))
+
+	case OpCodeAdd:
+		return v.arithmetic(frame, ArithmeticAdd, byteCode, registers[byteCode.args[2]])
+	case OpCodeAddConst:
+		return v.arithmetic(frame, ArithmeticAdd, byteCode, constants[byteCode.args[2]])
+	case OpCodeSubtract:
+		return v.arithmetic(frame, ArithmeticSubtract, byteCode, registers[byteCode.args[2]])
+	case OpCodeSubtractConst:
+		return v.arithmetic(frame, ArithmeticSubtract, byteCode, constants[byteCode.args[2]])
+	case OpCodeMultiply:
+		return v.arithmetic(frame, ArithmeticMultiply, byteCode, registers[byteCode.args[2]])
+	case OpCodeMultiplyConst:
+		return v.arithmetic(frame, ArithmeticMultiply, byteCode, constants[byteCode.args[2]])
+	case OpCodeDivide:
+		return v.arithmetic(frame, ArithmeticDivide, byteCode, registers[byteCode.args[2]])
+	case OpCodeDivideConst:
+		return v.arithmetic(frame, ArithmeticDivide, byteCode, constants[byteCode.args[2]])
+	case OpCodeFloorDivide:
+		return v.arithmetic(frame, ArithmeticFloorDivide, byteCode, registers[byteCode.args[2]])
+	case OpCodeFloorDivideConst:
+		return v.arithmetic(frame, ArithmeticFloorDivide, byteCode, constants[byteCode.args[2]])
+	case OpCodeModulo:
+		return v.arithmetic(frame, ArithmeticModulo, byteCode, registers[byteCode.args[2]])
+	case OpCodeModuloConst:
+		return v.arithmetic(frame, ArithmeticModulo, byteCode, constants[byteCode.args[2]])
+	case OpCodePower:
+		return v.arithmetic(frame, ArithmeticPower, byteCode, registers[byteCode.args[2]])
+	case OpCodePowerConst:
+		return v.arithmetic(frame, ArithmeticPower, byteCode, constants[byteCode.args[2]])
+	case OpCodeBitAnd:
+		return v.arithmetic(frame, ArithmeticBitAnd, byteCode, registers[byteCode.args[2]])
+	case OpCodeBitAndConst:
+		return v.arithmetic(frame, ArithmeticBitAnd, byteCode, constants[byteCode.args[2]])
+	case OpCodeBitOr:
+		return v.arithmetic(frame, ArithmeticBitOr, byteCode, registers[byteCode.args[2]])
+	case OpCodeBitOrConst:
+		return v.arithmetic(frame, ArithmeticBitOr, byteCode, constants[byteCode.args[2]])
+	case OpCodeBitXor:
+		return v.arithmetic(frame, ArithmeticBitXor, byteCode, registers[byteCode.args[2]])
+	case OpCodeBitXorConst:
+		return v.arithmetic(frame, ArithmeticBitXor, byteCode, constants[byteCode.args[2]])
+	case OpCodeShiftLeft:
+		return v.arithmetic(frame, ArithmeticShiftLeft, byteCode, registers[byteCode.args[2]])
+	case OpCodeShiftLeftConst:
+		return v.arithmetic(frame, ArithmeticShiftLeft, byteCode, constants[byteCode.args[2]])
+	case OpCodeShiftRight:
+		return v.arithmetic(frame, ArithmeticShiftRight, byteCode, registers[byteCode.args[2]])
+	case OpCodeShiftRightConst:
+		return v.arithmetic(frame, ArithmeticShiftRight, byteCode, constants[byteCode.args[2]])
+
+	case OpCodeEqual:
+		return v.equal(frame, byteCode.args[0], registers[byteCode.args[1]], registers[byteCode.args[2]], false)
+	case OpCodeEqualConst:
+		return v.equal(frame, byteCode.args[0], registers[byteCode.args[1]], constants[byteCode.args[2]], false)
+	case OpCodeNotEqual:
+		return v.equal(frame, byteCode.args[0], registers[byteCode.args[1]], registers[byteCode.args[2]], true)
+	case OpCodeNotEqualConst:
+		return v.equal(frame, byteCode.args[0], registers[byteCode.args[1]], constants[byteCode.args[2]], true)
+	case OpCodeLess:
+		return v.compare(frame, byteCode.args[0], lessThan, "__lt", registers[byteCode.args[1]], registers[byteCode.args[2]])
+	case OpCodeLessConst:
+		return v.compare(frame, byteCode.args[0], lessThan, "__lt", registers[byteCode.args[1]], constants[byteCode.args[2]])
+	case OpCodeLessEqual:
+		return v.compare(frame, byteCode.args[0], lessEqual, "__le", registers[byteCode.args[1]], registers[byteCode.args[2]])
+	case OpCodeLessEqualConst:
+		return v.compare(frame, byteCode.args[0], lessEqual, "__le", registers[byteCode.args[1]], constants[byteCode.args[2]])
+	case OpCodeGreaterConst:
+		return v.compare(frame, byteCode.args[0], lessThan, "__lt", constants[byteCode.args[2]], registers[byteCode.args[1]])
+	case OpCodeGreaterEqualConst:
+		return v.compare(frame, byteCode.args[0], lessEqual, "__le", constants[byteCode.args[2]], registers[byteCode.args[1]])
+
+	case OpCodeJump:
+		frame.pc += int(int16(binary.BigEndian.Uint16(byteCode.args[1:])))
+
+	case OpCodeForPrepare:
+		runsLoop, err := v.forPrepare(frame.base + int(byteCode.args[0]))
+		if err != nil {
+			return err
+		}
+		if !runsLoop {
+			frame.pc += int(int16(binary.BigEndian.Uint16(byteCode.args[1:])))
+		}
+
+	case OpCodeForLoop:
+		if v.forLoop(frame.base + int(byteCode.args[0])) {
+			frame.pc += int(int16(binary.BigEndian.Uint16(byteCode.args[1:])))
+		}
+
+	case OpCodeGenericForPrepare:
+		if err := v.markToBeClosed(frame.base+int(byteCode.args[0])+3, "(for state)"); err != nil {
+			return err
+		}
+		frame.pc += int(int16(binary.BigEndian.Uint16(byteCode.args[1:])))
+
+	case OpCodeGenericForCall:
+		base := byteCode.args[0]
+		variableCount := int(byteCode.args[1])
+
+		// the iterator is called on a copy of function, state and control value, so the results can be
+		// stored where the loop variables are
+		registers[base+6] = registers[base+2]
+		registers[base+5] = registers[base+1]
+		registers[base+4] = registers[base]
+
+		if err := v.call(frame.base+int(base)+4, 2, variableCount); err != nil {
+			return err
+		}
+
+	case OpCodeGenericForLoop:
+		base := byteCode.args[0]
+
+		if control := registers[base+4]; control.valueType != TypeNil {
+			registers[base+2] = control
+			frame.pc += int(int16(binary.BigEndian.Uint16(byteCode.args[1:])))
+		}
+
+	case OpCodeTest:
+		stackIndex := byteCode.args[0]
+		jumpIf := byteCode.args[1] == 1
+
+		if registers[stackIndex].IsTruthy() != jumpIf {
+			// skip the jump following the test
+			frame.pc++
+		}
+
+	case OpCodeTestSet:
+		destinationStackIndex := byteCode.args[0]
+		sourceStackIndex := byteCode.args[1]
+		jumpIf := byteCode.args[2] == 1
+
+		value := registers[sourceStackIndex]
+		if value.IsTruthy() != jumpIf {
+			frame.pc++
+		} else {
+			registers[destinationStackIndex] = value
+		}
 
 	default:
 		panic(fmt.Sprintf("unexpected vm.OpCode: %#v", byteCode.opCode))
@@ -346,16 +577,91 @@ func (v *VM) step(byteCode ByteCode, constants []Value) error {
 	return nil
 }
 
+// ArgCount returns the number of arguments passed to the currently called Go function.
+func (v *VM) ArgCount() int {
+	return v.top - v.funcIndex - 1
+}
+
+// Arg returns the argument at index, counting from zero, of the currently called Go function. Missing
+// arguments are nil.
+func (v *VM) Arg(index int) Value {
+	if index < 0 || index >= v.ArgCount() {
+		return NewNil()
+	}
+
+	return v.stack[v.funcIndex+1+index]
+}
+
+// Push adds a result of the currently called Go function. The function has to return the number of
+// pushed results.
+func (v *VM) Push(value Value) {
+	v.setStack(v.top, value)
+	v.top++
+}
+
 func (v *VM) setStack(index int, value Value) {
 	for i := len(v.stack); i <= index; i++ {
-		v.stack = append(v.stack, Value{})
+		v.stack = append(v.stack, NewNil())
 	}
 
 	v.stack[index] = value
 }
 
-func (v *VM) getTable(index byte) (*Table, error) {
-	tableValue := v.stack[index]
+// arithmetic combines the register args[1] with right and stores the result at args[0]. Operands which
+// are no numbers may define the operation by a metamethod.
+func (v *VM) arithmetic(frame *callFrame, operator ArithmeticOperator, byteCode ByteCode, right Value) error {
+	base := frame.base
+	left := v.stack[base+int(byteCode.args[1])]
+
+	result, err := Arithmetic(operator, left, right)
+	if err != nil {
+		if result, err = v.binaryMetamethod(arithmeticEvents[operator], left, right, err); err != nil {
+			return err
+		}
+	}
+
+	v.stack[base+int(byteCode.args[0])] = result
+	return nil
+}
+
+// compare stores the result of the comparison at the register destination. Operands which can not be
+// compared may define the comparison by the metamethod for event.
+func (v *VM) compare(frame *callFrame, destination byte, comparison func(a, b Value) (bool, error), event string, left, right Value) error {
+	base := frame.base
+
+	result, err := comparison(left, right)
+	if err != nil {
+		value, err := v.binaryMetamethod(event, left, right, err)
+		if err != nil {
+			return err
+		}
+		result = value.IsTruthy()
+	}
+
+	v.stack[base+int(destination)] = NewBoolean(result)
+	return nil
+}
+
+// equal stores whether left and right are equal at the register destination or whether they differ if
+// negate is set. Two different tables are compared by their __eq metamethod.
+func (v *VM) equal(frame *callFrame, destination byte, left, right Value, negate bool) error {
+	base := frame.base
+
+	result := RawEqual(left, right)
+	if !result && left.valueType == right.valueType && (left.valueType == TypeTable || left.valueType == TypeUserdata) {
+		value, err := v.binaryMetamethod("__eq", left, right, nil)
+		if err != nil {
+			return err
+		}
+		result = value.IsTruthy()
+	}
+
+	v.stack[base+int(destination)] = NewBoolean(result != negate)
+	return nil
+}
+
+func getTable(registers []Value, index byte) (*Table, error) {
+	tableValue := registers[index]
 	if tableValue.valueType != TypeTable {
 		return nil, fmt.Errorf("expected stack value at %v to be a Table but it is of type %v", index, tableValue.valueType)
 	}
@@ -363,10 +669,21 @@ func (v *VM) getTable(index byte) (*Table, error) {
 	return tableValue.inner.(*Table), nil
 }
 
-func Print(vm *VM) int {
-	stackItem := vm.stack[vm.funcIndex+1]
-	fmt.Fprintf(vm.out, "%v\n", stackItem)
-	return 0
+// Print writes its arguments separated by tabs. They are converted to strings like tostring does.
+func Print(vm *VM) (int, error) {
+	for i := range vm.ArgCount() {
+		str, err := vm.toString(vm.Arg(i))
+		if err != nil {
+			return 0, err
+		}
+
+		if i > 0 {
+			fmt.Fprint(vm.out, "\t")
+		}
+		fmt.Fprint(vm.out, str)
+	}
+	fmt.Fprintln(vm.out)
+	return 0, nil
 }
 
 type OpCode byte
@@ -398,6 +715,57 @@ const (
 	OpCodeNot
 	OpCodeBitNot
 	OpCodeLength
+	OpCodeAdd
+	OpCodeAddConst
+	OpCodeSubtract
+	OpCodeSubtractConst
+	OpCodeMultiply
+	OpCodeMultiplyConst
+	OpCodeDivide
+	OpCodeDivideConst
+	OpCodeFloorDivide
+	OpCodeFloorDivideConst
+	OpCodeModulo
+	OpCodeModuloConst
+	OpCodePower
+	OpCodePowerConst
+	OpCodeEqual
+	OpCodeEqualConst
+	OpCodeNotEqual
+	OpCodeNotEqualConst
+	OpCodeLess
+	OpCodeLessConst
+	OpCodeLessEqual
+	OpCodeLessEqualConst
+	OpCodeGreaterConst
+	OpCodeGreaterEqualConst
+	OpCodeJump
+	OpCodeTest
+	OpCodeTestSet
+	OpCodeForPrepare
+	OpCodeForLoop
+	OpCodeGenericForPrepare
+	OpCodeGenericForCall
+	OpCodeGenericForLoop
+	OpCodeReturn
+	OpCodeClosure
+	OpCodeGetUpvalue
+	OpCodeSetUpvalue
+	OpCodeClose
+	OpCodeVararg
+	OpCodeSelf
+	OpCodeConcat
+	OpCodeBitAnd
+	OpCodeBitAndConst
+	OpCodeBitOr
+	OpCodeBitOrConst
+	OpCodeBitXor
+	OpCodeBitXorConst
+	OpCodeShiftLeft
+	OpCodeShiftLeftConst
+	OpCodeShiftRight
+	OpCodeShiftRightConst
+	OpCodeToBeClosed
 )
 
 type ByteCode struct {
@@ -417,8 +785,18 @@ func LoadConst(stackIndex, constIndex byte) ByteCode {
 	return ByteCode{OpCodeLoadConst, [3]byte{stackIndex, constIndex}}
 }
 
-func Call(stackIndex, parameters byte) ByteCode {
-	return ByteCode{OpCodeCall, [3]byte{stackIndex, parameters}}
+// VariableCount replaces the argument count of Call, the result count of Call, the count of Return, the
+// count of Vararg and the list size of SetList. The values then reach up to the top of the stack, which is set by the preceding
+// call with a variable number of results.
+const VariableCount byte = math.MaxUint8
+
+// ListBatchSize is the number of list items of a table constructor a SetList byte code stores at most.
+const ListBatchSize = 50
+
+// Call calls the function at stackIndex with argCount arguments following it. The results replace the
+// function and its arguments, they are truncated or padded with nil to resultCount values.
+func Call(stackIndex, argCount, resultCount byte) ByteCode {
+	return ByteCode{OpCodeCall, [3]byte{stackIndex, argCount, resultCount}}
 }
 
 func LoadNil(stackIndex byte) ByteCode {
@@ -426,12 +804,7 @@ func LoadNil(stackIndex byte) ByteCode {
 }
 
 func LoadBool(stackIndex byte, value bool) ByteCode {
-	var byteValue byte = 0
-	if value {
-		byteValue = 1
-	}
-
-	return ByteCode{OpCodeLoadBool, [3]byte{stackIndex, byteValue}}
+	return ByteCode{OpCodeLoadBool, [3]byte{stackIndex, boolToByte(value)}}
 }
 
 func LoadInt(stackIndex byte, value int16) ByteCode {
@@ -484,8 +857,10 @@ func SetFieldConst(tableStackIndex, keyConstIndex, valueConstIndex byte) ByteCod
 	return ByteCode{OpCodeSetFieldConst, [3]byte{tableStackIndex, keyConstIndex, valueConstIndex}}
 }
 
-func SetList(tableStackIndex, length byte) ByteCode {
-	return ByteCode{OpCodeSetList, [3]byte{tableStackIndex, length}}
+// SetList stores the length values following the table at tableStackIndex in the table. They are the list
+// items of the batch-th batch of a table constructor, each batch holds ListBatchSize items.
+func SetList(tableStackIndex, length, batch byte) ByteCode {
+	return ByteCode{OpCodeSetList, [3]byte{tableStackIndex, length, batch}}
 }
 
 func GetTable(stackIndex, tableStackIndex, keyStackIndex byte) ByteCode {
@@ -516,145 +891,352 @@ func Length(destinationStackIndex, sourceStackIndex byte) ByteCode {
 	return ByteCode{OpCodeLength, [3]byte{destinationStackIndex, sourceStackIndex}}
 }
 
-type Value struct {
-	valueType Type
-	inner     any //TODO store basic types in separate variable
+func Add(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeAdd, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
 }
 
-func (v Value) String() string {
-	switch v.valueType {
-	case TypeFunction:
-		return "function"
-	default:
-		return fmt.Sprint(v.inner)
-	}
+func AddConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeAddConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
 }
 
-//go:generate go tool stringer -type=Type -trimprefix Type
+func Subtract(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeSubtract, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
+}
 
-type Type int
+func SubtractConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeSubtractConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
+}
 
-const (
-	TypeString Type = iota
-	TypeFloat
-	TypeInteger
-	TypeFunction
-	TypeBoolean
-	TypeNil
-	TypeTable
-)
+func Multiply(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeMultiply, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
+}
 
-func NewNil() Value {
-	return Value{TypeNil, nil}
+func MultiplyConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeMultiplyConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
 }
 
-func NewString(value string) Value {
-	return Value{TypeString, value}
+func Divide(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeDivide, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
 }
 
-func NewFuntion(fn vmFunc) Value {
-	return Value{TypeFunction, fn}
+func DivideConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeDivideConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
 }
 
-func NewInteger(value int64) Value {
-	return Value{TypeInteger, value}
+func FloorDivide(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeFloorDivide, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
 }
 
-func NewFloat(value float64) Value {
-	return Value{TypeFloat, value}
+func FloorDivideConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeFloorDivideConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
 }
 
-func NewBoolean(value bool) Value {
-	return Value{TypeBoolean, value}
+func Modulo(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeModulo, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
 }
 
-func NewTable(value *Table) Value {
-	return Value{TypeTable, value}
+func ModuloConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeModuloConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
 }
 
-type Table struct {
-	array   []Value
-	hashMap map[Value]Value
+func Power(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodePower, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
 }
 
-func (t *Table) String() string {
-	var stringBuilder strings.Builder
+func PowerConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodePowerConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
+}
 
-	stringBuilder.WriteString("Table{")
+func BitAnd(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeBitAnd, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
+}
 
-	for i, value := range t.array {
-		fmt.Fprintf(&stringBuilder, "%v=%v", i, value)
-		if i < len(t.array)-1 {
-			stringBuilder.WriteRune(',')
-		}
+func BitAndConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeBitAndConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
+}
+
+func BitOr(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeBitOr, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
+}
+
+func BitOrConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeBitOrConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
+}
+
+func BitXor(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeBitXor, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
+}
+
+func BitXorConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeBitXorConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
+}
+
+func ShiftLeft(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeShiftLeft, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
+}
+
+func ShiftLeftConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeShiftLeftConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
+}
+
+func ShiftRight(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeShiftRight, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
+}
+
+func ShiftRightConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeShiftRightConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
+}
+
+func Equal(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeEqual, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
+}
+
+func EqualConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeEqualConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
+}
+
+func NotEqual(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeNotEqual, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
+}
+
+func NotEqualConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeNotEqualConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
+}
+
+func Less(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeLess, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
+}
+
+func LessConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeLessConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
+}
+
+func LessEqual(destinationStackIndex, leftStackIndex, rightStackIndex byte) ByteCode {
+	return ByteCode{OpCodeLessEqual, [3]byte{destinationStackIndex, leftStackIndex, rightStackIndex}}
+}
+
+func LessEqualConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeLessEqualConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
+}
+
+func GreaterConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeGreaterConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
+}
+
+func GreaterEqualConst(destinationStackIndex, leftStackIndex, rightConstIndex byte) ByteCode {
+	return ByteCode{OpCodeGreaterEqualConst, [3]byte{destinationStackIndex, leftStackIndex, rightConstIndex}}
+}
+
+// Jump continues execution offset byte codes after the jump.
+func Jump(offset int16) ByteCode {
+	bytes := [3]byte{}
+	binary.BigEndian.PutUint16(bytes[1:], uint16(offset))
+	return ByteCode{OpCodeJump, bytes}
+}
+
+// Test executes the following jump if the truthiness of the stack value equals jumpIf and skips it otherwise.
+func Test(stackIndex byte, jumpIf bool) ByteCode {
+	return ByteCode{OpCodeTest, [3]byte{stackIndex, boolToByte(jumpIf)}}
+}
+
+// TestSet works like Test but also copies the source to the destination if the jump is executed.
+func TestSet(destinationStackIndex, sourceStackIndex byte, jumpIf bool) ByteCode {
+	return ByteCode{OpCodeTestSet, [3]byte{destinationStackIndex, sourceStackIndex, boolToByte(jumpIf)}}
+}
+
+// ForPrepare initializes a numeric for loop at baseStackIndex and jumps behind the loop if it is not executed.
+func ForPrepare(baseStackIndex byte, skipOffset int16) ByteCode {
+	bytes := [3]byte{baseStackIndex}
+	binary.BigEndian.PutUint16(bytes[1:], uint16(skipOffset))
+	return ByteCode{OpCodeForPrepare, bytes}
+}
+
+// ForLoop advances a numeric for loop at baseStackIndex and jumps back to the loop body if it continues.
+func ForLoop(baseStackIndex byte, loopOffset int16) ByteCode {
+	bytes := [3]byte{baseStackIndex}
+	binary.BigEndian.PutUint16(bytes[1:], uint16(loopOffset))
+	return ByteCode{OpCodeForLoop, bytes}
+}
+
+// GenericForPrepare starts a generic for loop at baseStackIndex by jumping to its GenericForCall.
+func GenericForPrepare(baseStackIndex byte, callOffset int16) ByteCode {
+	bytes := [3]byte{baseStackIndex}
+	binary.BigEndian.PutUint16(bytes[1:], uint16(callOffset))
+	return ByteCode{OpCodeGenericForPrepare, bytes}
+}
+
+// GenericForCall calls the iterator function of a generic for loop at baseStackIndex with its state and
+// control value and stores variableCount results in the loop variables.
+func GenericForCall(baseStackIndex, variableCount byte) ByteCode {
+	return ByteCode{OpCodeGenericForCall, [3]byte{baseStackIndex, variableCount}}
+}
+
+// GenericForLoop jumps back to the loop body as long as the first loop variable is not nil.
+func GenericForLoop(baseStackIndex byte, loopOffset int16) ByteCode {
+	bytes := [3]byte{baseStackIndex}
+	binary.BigEndian.PutUint16(bytes[1:], uint16(loopOffset))
+	return ByteCode{OpCodeGenericForLoop, bytes}
+}
+
+// Return returns count values starting at firstStackIndex to the caller.
+func Return(firstStackIndex, count byte) ByteCode {
+	return ByteCode{OpCodeReturn, [3]byte{firstStackIndex, count}}
+}
+
+// Closure creates a function from the prototype at prototypeIndex of the running function.
+func Closure(stackIndex, prototypeIndex byte) ByteCode {
+	return ByteCode{OpCodeClosure, [3]byte{stackIndex, prototypeIndex}}
+}
+
+func GetUpvalue(stackIndex, upvalueIndex byte) ByteCode {
+	return ByteCode{OpCodeGetUpvalue, [3]byte{stackIndex, upvalueIndex}}
+}
+
+func SetUpvalue(upvalueIndex, stackIndex byte) ByteCode {
+	return ByteCode{OpCodeSetUpvalue, [3]byte{upvalueIndex, stackIndex}}
+}
+
+// Close closes the upvalues and close locals of all locals from stackIndex on, which go out of scope.
+func Close(stackIndex byte) ByteCode {
+	return ByteCode{OpCodeClose, [3]byte{stackIndex}}
+}
+
+// ToBeClosed marks the local at stackIndex as close local, the constant is its name.
+func ToBeClosed(stackIndex, nameConstIndex byte) ByteCode {
+	return ByteCode{OpCodeToBeClosed, [3]byte{stackIndex, nameConstIndex}}
+}
+
+// Vararg copies count extra arguments of a vararg function to stackIndex, count may be VariableCount.
+func Vararg(stackIndex, count byte) ByteCode {
+	return ByteCode{OpCodeVararg, [3]byte{stackIndex, count}}
+}
+
+// Self prepares a method call by loading the method named by the constant from the table at tableStackIndex
+// to stackIndex and the table itself to stackIndex+1, where it is passed as the first argument.
+func Self(stackIndex, tableStackIndex, keyConstIndex byte) ByteCode {
+	return ByteCode{OpCodeSelf, [3]byte{stackIndex, tableStackIndex, keyConstIndex}}
+}
+
+// ConcatByteCode concatenates the count values starting at firstStackIndex and stores the result at stackIndex.
+func ConcatByteCode(stackIndex, firstStackIndex, count byte) ByteCode {
+	return ByteCode{OpCodeConcat, [3]byte{stackIndex, firstStackIndex, count}}
+}
+
+func boolToByte(value bool) byte {
+	if value {
+		return 1
 	}
+	return 0
+}
 
-	if len(t.array) > 0 && len(t.hashMap) > 0 {
-		stringBuilder.WriteRune(',')
+// Value is a Lua value. Numbers and booleans are stored in payload, so creating them does not allocate and
+// reading them needs no type assertion. Strings, functions, tables and userdata are stored in inner.
+type Value struct {
+	valueType Type
+	// payload holds integers, the bits of floats and 1 for true.
+	payload uint64
+	inner   any
+}
+
+// String formats the value like print does without calling the __tostring metamethod. Tables whose
+// metatable has a __name field are formatted as the name and their address.
+func (v Value) String() string {
+	switch v.valueType {
+	case TypeNil:
+		return "<nil>"
+	case TypeString:
+		return v.inner.(string)
+	case TypeInteger:
+		return strconv.FormatInt(v.integer(), 10)
+	case TypeFloat:
+		return formatFloat(v.float())
+	case TypeBoolean:
+		return strconv.FormatBool(v.boolean())
+	case TypeFunction:
+		return "function"
+	case TypeTable:
+		return v.inner.(*Table).String()
+	case TypeUserdata:
+		return v.inner.(*Userdata).String()
+	default:
+		return fmt.Sprint(v.inner)
 	}
+}
 
-	sortedKeys := slices.SortedFunc(maps.Keys(t.hashMap), func(a, b Value) int {
-		return strings.Compare(a.String(), b.String())
-	})
-	for _, key := range sortedKeys {
-		fmt.Fprintf(&stringBuilder, "%v=%v", key, t.hashMap[key])
-		stringBuilder.WriteRune(',')
+// IsTruthy reports whether the value counts as true in conditions, which is everything except nil and false.
+func (v Value) IsTruthy() bool {
+	switch v.valueType {
+	case TypeNil:
+		return false
+	case TypeBoolean:
+		return v.boolean()
+	default:
+		return true
 	}
+}
 
-	str := stringBuilder.String()
-	str = strings.TrimSuffix(str, ",")
-	str += "}"
+func (v Value) Integer() (int64, bool) {
+	return v.integer(), v.valueType == TypeInteger
+}
 
-	return str
+func (v Value) Float() (float64, bool) {
+	return v.float(), v.valueType == TypeFloat
 }
 
-func (t *Table) Get(key Value) Value {
-	if key.inner == TypeInteger {
-		index := key.inner.(int64)
-		return t.At(index)
-	}
+// integer, float and boolean return the payload of values of the respective type.
+func (v Value) integer() int64 {
+	return int64(v.payload)
+}
 
-	value, ok := t.hashMap[key]
-	if !ok {
-		return NewNil()
-	}
+func (v Value) float() float64 {
+	return math.Float64frombits(v.payload)
+}
 
-	return value
+func (v Value) boolean() bool {
+	return v.payload != 0
 }
 
-func (t *Table) At(index int64) Value {
-	if int64(len(t.array)) <= index {
-		return NewNil()
-	}
+//go:generate go tool stringer -type=Type -trimprefix Type
+
+type Type int
+
+// The zero Value is nil, so unset stack slots and table entries read as nil.
+const (
+	TypeNil Type = iota
+	TypeString
+	TypeFloat
+	TypeInteger
+	TypeFunction
+	TypeBoolean
+	TypeTable
+	TypeUserdata
+)
 
-	return t.array[index]
+func NewNil() Value {
+	return Value{valueType: TypeNil}
 }
 
-func (t *Table) Put(key, value Value) {
-	if key.inner == TypeInteger {
-		index := key.inner.(int64)
-		t.Set(index, value)
-		return
-	}
+func NewString(value string) Value {
+	return Value{valueType: TypeString, inner: value}
+}
 
-	t.hashMap[key] = value
+func NewFuntion(fn vmFunc) Value {
+	// funcs are not comparable, referencing them gives functions an identity
+	return Value{valueType: TypeFunction, inner: &fn}
 }
 
-func (t *Table) Set(index int64, value Value) {
-	for index > int64(len(t.array)) {
-		t.array = append(t.array, NewNil())
-	}
+func NewInteger(value int64) Value {
+	return Value{valueType: TypeInteger, payload: uint64(value)}
+}
 
-	t.array = append(t.array, value)
+func NewFloat(value float64) Value {
+	return Value{valueType: TypeFloat, payload: math.Float64bits(value)}
 }
 
-func (t *Table) Add(value Value) {
-	if len(t.array) == 0 {
-		t.array = append(t.array, NewNil())
-	}
-	t.array = append(t.array, value)
+func NewBoolean(value bool) Value {
+	return Value{valueType: TypeBoolean, payload: uint64(boolToByte(value))}
 }
 
-func (t *Table) Length() int{
-	return len(t.array) + len(t.hashMap)
+func NewTable(value *Table) Value {
+	return Value{valueType: TypeTable, inner: value}
 }
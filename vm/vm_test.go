@@ -0,0 +1,70 @@
+package vm_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"luingo/logging"
+	"luingo/parser"
+	"luingo/vm"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func BenchmarkExecute(b *testing.B) {
+	benchmarks := []struct {
+		desc string
+		code string
+	}{
+		{
+			desc: "integer arithmetic",
+			code: `
+local sum = 0
+for i = 1, 10000 do
+  sum = sum + i * 3 // 2 - i % 7
+end`,
+		},
+		{
+			desc: "float arithmetic",
+			code: `
+local x = 0.5
+for i = 1, 10000 do
+  x = x * 1.000001 + i / 3
+end`,
+		},
+		{
+			desc: "comparisons",
+			code: `
+local count = 0
+for i = 1, 10000 do
+  if i % 3 == 0 and i < 9000 then
+    count = count + 1
+  end
+end`,
+		},
+		{
+			desc: "while loop",
+			code: `
+local i, fib1, fib2 = 0, 0, 1
+while i < 10000 do
+  fib1, fib2 = fib2, (fib1 + fib2) % 1000000
+  i = i + 1
+end`,
+		},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.desc, func(b *testing.B) {
+			prototype, err := parser.NewParser(bm.code).Parse()
+			require.NoError(b, err)
+
+			ctx := logging.WithLogger(context.Background(), slog.New(slog.DiscardHandler))
+			machine := vm.NewVM(map[string]vm.Value{}, io.Discard)
+
+			b.ReportAllocs()
+			for b.Loop() {
+				require.NoError(b, machine.Execute(ctx, prototype))
+			}
+		})
+	}
+}